@@ -0,0 +1,110 @@
+package gradeOutbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type fileStore struct {
+	mu       sync.Mutex
+	jsonPath string
+	entries  map[string]Entry
+}
+
+// NewFileStore creates a Store that keeps entries in a json file, which is rewritten on every change.
+// The file is created if it doesn't exist.
+func NewFileStore(jsonPath string) (Store, error) {
+	s := &fileStore{jsonPath: jsonPath, entries: make(map[string]Entry)}
+	file, err := os.Open(jsonPath)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []Entry
+	if err := json.NewDecoder(file).Decode(&entries); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		s.entries[entry.ID] = entry
+	}
+	return s, nil
+}
+
+func (s *fileStore) Save(entry Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, existed := s.entries[entry.ID]
+	s.entries[entry.ID] = entry
+	if err := s.writeFile(); err != nil {
+		// keep memory consistent with the file
+		if existed {
+			s.entries[entry.ID] = previous
+		} else {
+			delete(s.entries, entry.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) Get(id string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, exists := s.entries[id]
+	if !exists {
+		return nil, ErrEntryNotFound
+	}
+	return &entry, nil
+}
+
+func (s *fileStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, existed := s.entries[id]
+	if !existed {
+		return nil
+	}
+	delete(s.entries, id)
+	if err := s.writeFile(); err != nil {
+		s.entries[id] = previous
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) List() ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedEntries(s.entries), nil
+}
+
+// writeFile replaces the json file with the current entries, the caller must hold the lock
+func (s *fileStore) writeFile() error {
+	b, err := json.MarshalIndent(sortedEntries(s.entries), "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temp file and rename, so a failed write can't lose the queued grades
+	tmp, err := ioutil.TempFile(filepath.Dir(s.jsonPath), filepath.Base(s.jsonPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.jsonPath)
+}
@@ -0,0 +1,320 @@
+package gradeOutbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+var (
+	// ErrEntryNotFound is returned when the outbox has no entry with the given id
+	ErrEntryNotFound = errors.New("outbox entry not found")
+	// ErrEntrySending is returned when replaying or removing an entry that is being sent
+	ErrEntrySending = errors.New("outbox entry is being sent")
+)
+
+// Status is where an entry is in the outbox
+type Status string
+
+const (
+	// StatusPending entries are waiting to be sent (or retried)
+	StatusPending Status = "pending"
+	// StatusDead entries failed permanently, or ran out of attempts.  They stay until replayed or removed.
+	StatusDead Status = "dead"
+)
+
+// Entry is a score submission waiting in the outbox
+type Entry struct {
+	ID       string `json:"id"`
+	Issuer   string `json:"issuer"`
+	ClientID string `json:"clientId"`
+	// ScoreURL is the line item's scores url the score is posted to, "" if the line item is found when sending
+	ScoreURL string `json:"scoreUrl"`
+	// LineItemsURL and LineItem are the line items service and line item (found or created by tag) the score is
+	// posted to, for scores queued before the line item's id was known
+	LineItemsURL string          `json:"lineItemsUrl,omitempty"`
+	LineItem     json.RawMessage `json:"lineItem,omitempty"`
+	Scopes       []string        `json:"scopes"`
+	UserID       string          `json:"userId"`
+	// Score is the score's json, as posted to the platform
+	Score       json.RawMessage `json:"score"`
+	Status      Status          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	LastError   string          `json:"lastError,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+}
+
+// Store persists the outbox's entries
+type Store interface {
+	// Save adds the entry, or replaces the entry with the same id
+	Save(entry Entry) error
+	// Get returns ErrEntryNotFound if there is no entry with the id
+	Get(id string) (*Entry, error)
+	Remove(id string) error
+	// List returns every entry, oldest first
+	List() ([]Entry, error)
+}
+
+// Sender posts an entry's score to the platform, giving up when the context is done.  Errors are retried unless
+// wrapped with Permanent.
+type Sender func(ctx context.Context, entry Entry) error
+
+// PermanentError marks a send failure that retrying won't fix (eg: the platform rejected the score)
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return fmt.Sprintf("permanent failure: %v", e.Err)
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps err so the outbox dead-letters the entry rather than retrying it
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+// RetryPolicy is how the outbox retries failed sends: the delay doubles after each attempt, from BaseDelay up to MaxDelay,
+// and the entry is dead-lettered after MaxAttempts
+type RetryPolicy struct {
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxAttempts int
+}
+
+// DefaultRetryPolicy retries for about a day
+var DefaultRetryPolicy = RetryPolicy{BaseDelay: 30 * time.Second, MaxDelay: time.Hour, MaxAttempts: 30}
+
+// Outbox records score submissions in a Store, then sends them (retrying as needed) from Run or ProcessDue.
+// Delivery is at least once: an entry is only removed after the platform accepts its score, so if the process stops
+// in between, or the platform's response is lost, the same score (with the same timestamp) is posted again.  Platforms
+// may record such a duplicate.
+type Outbox struct {
+	store  Store
+	send   Sender
+	policy RetryPolicy
+	// a pass over the entries must not run twice at once, or entries could be sent twice
+	processMu sync.Mutex
+	// entryMu guards changes to stored entries, and sending (the ids of the entries being sent)
+	entryMu sync.Mutex
+	sending map[string]bool
+	wake    chan struct{}
+}
+
+// NewOutbox creates an Outbox that keeps its entries in store and sends them with send
+func NewOutbox(store Store, send Sender, policy RetryPolicy) *Outbox {
+	return &Outbox{store: store, send: send, policy: policy, sending: make(map[string]bool), wake: make(chan struct{}, 1)}
+}
+
+// Enqueue persists the entry as pending, to be sent by the worker.  The id, status and times are set by the outbox.
+func (o *Outbox) Enqueue(entry Entry) (*Entry, error) {
+	now := time.Now()
+	entry.ID = ksuid.New().String()
+	entry.Status = StatusPending
+	entry.Attempts = 0
+	entry.LastError = ""
+	entry.CreatedAt = now
+	entry.NextAttempt = now
+	if err := o.store.Save(entry); err != nil {
+		return nil, fmt.Errorf("failed to save outbox entry for user %q: %v", entry.UserID, err)
+	}
+	o.notify()
+	return &entry, nil
+}
+
+// Entries returns the entries with the given status, or all entries if status is ""
+func (o *Outbox) Entries(status Status) ([]Entry, error) {
+	entries, err := o.store.List()
+	if err != nil {
+		return nil, err
+	}
+	if status == "" {
+		return entries, nil
+	}
+	filtered := make([]Entry, 0)
+	for _, entry := range entries {
+		if entry.Status == status {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered, nil
+}
+
+// Replay makes the entry pending again, with its attempts reset, so it is sent on the next pass.
+// It returns ErrEntrySending if the entry is being sent.
+func (o *Outbox) Replay(id string) error {
+	o.entryMu.Lock()
+	defer o.entryMu.Unlock()
+	if o.sending[id] {
+		return ErrEntrySending
+	}
+	entry, err := o.store.Get(id)
+	if err != nil {
+		return err
+	}
+	entry.Status = StatusPending
+	entry.Attempts = 0
+	entry.NextAttempt = time.Now()
+	if err := o.store.Save(*entry); err != nil {
+		return err
+	}
+	o.notify()
+	return nil
+}
+
+// ReplayDeadLetters replays every dead entry, returning how many were replayed
+func (o *Outbox) ReplayDeadLetters() (int, error) {
+	dead, err := o.Entries(StatusDead)
+	if err != nil {
+		return 0, err
+	}
+	for i, entry := range dead {
+		if err := o.Replay(entry.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(dead), nil
+}
+
+// Remove discards the entry without sending it.  It returns ErrEntrySending if the entry is being sent.
+func (o *Outbox) Remove(id string) error {
+	o.entryMu.Lock()
+	defer o.entryMu.Unlock()
+	if o.sending[id] {
+		return ErrEntrySending
+	}
+	return o.store.Remove(id)
+}
+
+// ProcessDue sends every pending entry whose next attempt is due.  Sent entries are removed, failed ones are
+// rescheduled or dead-lettered.  It returns the number of entries sent.  When the context is done it stops, leaving an
+// entry whose send was interrupted pending without counting the attempt, and returns the context's error.
+func (o *Outbox) ProcessDue(ctx context.Context) (int, error) {
+	o.processMu.Lock()
+	defer o.processMu.Unlock()
+	entries, err := o.store.List()
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, listed := range entries {
+		if err := ctx.Err(); err != nil {
+			return sent, err
+		}
+		if listed.Status != StatusPending || time.Now().Before(listed.NextAttempt) {
+			continue
+		}
+		entry, err := o.claim(listed.ID)
+		if err != nil {
+			return sent, err
+		}
+		if entry == nil {
+			continue
+		}
+		sendErr := o.send(ctx, *entry)
+		if sendErr != nil && ctx.Err() != nil {
+			o.release(entry.ID)
+			return sent, ctx.Err()
+		}
+		if err := o.finish(entry, sendErr); err != nil {
+			return sent, err
+		}
+		if sendErr == nil {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// claim marks the entry as being sent, so it isn't replayed or removed meanwhile, and returns it as stored.
+// It returns nil if the entry is no longer due (eg: it was removed since the entries were listed).
+func (o *Outbox) claim(id string) (*Entry, error) {
+	o.entryMu.Lock()
+	defer o.entryMu.Unlock()
+	entry, err := o.store.Get(id)
+	if err == ErrEntryNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if entry.Status != StatusPending || time.Now().Before(entry.NextAttempt) {
+		return nil, nil
+	}
+	o.sending[id] = true
+	return entry, nil
+}
+
+// release gives up the claim on an entry whose send was interrupted, leaving it as stored
+func (o *Outbox) release(id string) {
+	o.entryMu.Lock()
+	defer o.entryMu.Unlock()
+	delete(o.sending, id)
+}
+
+// finish removes the claimed entry once sent, or reschedules or dead-letters it
+func (o *Outbox) finish(entry *Entry, sendErr error) error {
+	o.entryMu.Lock()
+	defer o.entryMu.Unlock()
+	delete(o.sending, entry.ID)
+	if sendErr == nil {
+		return o.store.Remove(entry.ID)
+	}
+	entry.Attempts++
+	entry.LastError = sendErr.Error()
+	var permanent *PermanentError
+	if errors.As(sendErr, &permanent) || (o.policy.MaxAttempts > 0 && entry.Attempts >= o.policy.MaxAttempts) {
+		log.Printf("outbox entry %q for user %q dead-lettered after %d attempt(s): %v", entry.ID, entry.UserID, entry.Attempts, sendErr)
+		entry.Status = StatusDead
+	} else {
+		entry.NextAttempt = time.Now().Add(o.policy.backoff(entry.Attempts))
+		log.Printf("outbox entry %q for user %q failed (attempt %d), retrying at %v: %v", entry.ID, entry.UserID, entry.Attempts, entry.NextAttempt, sendErr)
+	}
+	return o.store.Save(*entry)
+}
+
+// Run processes due entries every pollInterval, and straight away when entries are enqueued or replayed,
+// until the context is done.  The context is passed to the Sender, so an in-flight send is cancelled too.
+func (o *Outbox) Run(ctx context.Context, pollInterval time.Duration) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := o.ProcessDue(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("outbox processing failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// backoff returns the delay before the next attempt, after the given number of failed attempts
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return delay
+}
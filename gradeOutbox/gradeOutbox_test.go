@@ -0,0 +1,176 @@
+package gradeOutbox_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GRT/lti-1-3-go-library/gradeOutbox"
+)
+
+func TestOutboxRetryAndDeadLetter(t *testing.T) {
+	failures := map[string]error{
+		"flaky":    errors.New("platform down"),
+		"rejected": gradeOutbox.Permanent(errors.New("unknown user")),
+	}
+	sent := make([]string, 0)
+	send := func(ctx context.Context, entry gradeOutbox.Entry) error {
+		if err := failures[entry.UserID]; err != nil {
+			return err
+		}
+		sent = append(sent, entry.UserID)
+		return nil
+	}
+	outbox := gradeOutbox.NewOutbox(gradeOutbox.NewMemoryStore(), send, gradeOutbox.RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond, MaxAttempts: 3})
+	for _, userID := range []string{"ok", "flaky", "rejected"} {
+		if _, err := outbox.Enqueue(gradeOutbox.Entry{UserID: userID, Score: []byte(`{}`)}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+
+	if n, err := outbox.ProcessDue(context.Background()); err != nil || n != 1 {
+		t.Fatalf("expected 1 entry sent, got %d, %v", n, err)
+	}
+	dead, _ := outbox.Entries(gradeOutbox.StatusDead)
+	if len(dead) != 1 || dead[0].UserID != "rejected" {
+		t.Fatalf("a permanent failure should be dead-lettered straight away, got: %+v", dead)
+	}
+	pending, _ := outbox.Entries(gradeOutbox.StatusPending)
+	if len(pending) != 1 || pending[0].Attempts != 1 || !pending[0].NextAttempt.After(pending[0].CreatedAt) {
+		t.Fatalf("a transient failure should be rescheduled, got: %+v", pending)
+	}
+
+	// runs out of attempts
+	for i := 0; i < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		outbox.ProcessDue(context.Background())
+	}
+	dead, _ = outbox.Entries(gradeOutbox.StatusDead)
+	if len(dead) != 2 {
+		t.Fatalf("expected the flaky entry to be dead-lettered after its attempts, got: %+v", dead)
+	}
+
+	// once the platform recovers, the dead letters can be replayed
+	delete(failures, "flaky")
+	delete(failures, "rejected")
+	if n, err := outbox.ReplayDeadLetters(); err != nil || n != 2 {
+		t.Fatalf("expected 2 entries replayed, got %d, %v", n, err)
+	}
+	if n, _ := outbox.ProcessDue(context.Background()); n != 2 {
+		t.Fatalf("expected the replayed entries to be sent, got %d", n)
+	}
+	if all, _ := outbox.Entries(""); len(all) != 0 || len(sent) != 3 {
+		t.Fatalf("expected an empty outbox and 3 sends, got: %+v, sent: %v", all, sent)
+	}
+	if err := outbox.Replay("missing"); err != gradeOutbox.ErrEntryNotFound {
+		t.Fatalf("expected ErrEntryNotFound, got: %v", err)
+	}
+}
+
+func TestOutboxEntrySending(t *testing.T) {
+	var outbox *gradeOutbox.Outbox
+	var replayErr, removeErr error
+	send := func(ctx context.Context, entry gradeOutbox.Entry) error {
+		// the entry can't be replayed or removed while it's being sent
+		replayErr = outbox.Replay(entry.ID)
+		removeErr = outbox.Remove(entry.ID)
+		return errors.New("platform down")
+	}
+	outbox = gradeOutbox.NewOutbox(gradeOutbox.NewMemoryStore(), send, gradeOutbox.RetryPolicy{BaseDelay: time.Hour, MaxAttempts: 3})
+	entry, err := outbox.Enqueue(gradeOutbox.Entry{UserID: "u1", Score: []byte(`{}`)})
+	if err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	outbox.ProcessDue(context.Background())
+	if replayErr != gradeOutbox.ErrEntrySending || removeErr != gradeOutbox.ErrEntrySending {
+		t.Fatalf("expected ErrEntrySending, got: %v, %v", replayErr, removeErr)
+	}
+	pending, _ := outbox.Entries(gradeOutbox.StatusPending)
+	if len(pending) != 1 || pending[0].Attempts != 1 {
+		t.Fatalf("expected the failed attempt to be recorded, got: %+v", pending)
+	}
+
+	// once sent, it can be replayed and removed again
+	if err := outbox.Replay(entry.ID); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if err := outbox.Remove(entry.ID); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+}
+
+func TestOutboxCancelledSend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sends := 0
+	send := func(ctx context.Context, entry gradeOutbox.Entry) error {
+		sends++
+		// the process is shutting down while the score is being posted
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	outbox := gradeOutbox.NewOutbox(gradeOutbox.NewMemoryStore(), send, gradeOutbox.RetryPolicy{BaseDelay: time.Hour, MaxAttempts: 3})
+	for _, userID := range []string{"u1", "u2"} {
+		if _, err := outbox.Enqueue(gradeOutbox.Entry{UserID: userID, Score: []byte(`{}`)}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+	if _, err := outbox.ProcessDue(ctx); err != context.Canceled || sends != 1 {
+		t.Fatalf("expected processing to stop after the cancelled send, got: %v, %d sends", err, sends)
+	}
+	// the interrupted entry is still due, without the attempt counted
+	pending, _ := outbox.Entries(gradeOutbox.StatusPending)
+	if len(pending) != 2 || pending[0].Attempts != 0 || pending[1].Attempts != 0 {
+		t.Fatalf("expected both entries to stay pending, got: %+v", pending)
+	}
+	if err := outbox.Remove(pending[0].ID); err != nil {
+		t.Fatalf("the interrupted entry should no longer be claimed, got: %v", err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	jsonPath := filepath.Join(dir, "outbox.json")
+
+	store, err := gradeOutbox.NewFileStore(jsonPath)
+	if err != nil {
+		t.Fatalf("failed to create the file store: %v", err)
+	}
+	outbox := gradeOutbox.NewOutbox(store, func(context.Context, gradeOutbox.Entry) error { return errors.New("down") }, gradeOutbox.DefaultRetryPolicy)
+	entry, err := outbox.Enqueue(gradeOutbox.Entry{UserID: "u1", ScoreURL: "https://platform.example.com/lineitems/1/scores", Score: []byte(`{"scoreGiven":1}`)})
+	if err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	outbox.ProcessDue(context.Background())
+
+	// the entry, and its failed attempt, survive a restart
+	reloaded, err := gradeOutbox.NewFileStore(jsonPath)
+	if err != nil {
+		t.Fatalf("failed to reload the file store: %v", err)
+	}
+	got, err := reloaded.Get(entry.ID)
+	if err != nil {
+		t.Fatalf("entry was not persisted: %v", err)
+	}
+	var score bytes.Buffer
+	json.Compact(&score, got.Score)
+	if got.Attempts != 1 || got.LastError != "down" || score.String() != `{"scoreGiven":1}` {
+		t.Fatalf("unexpected persisted entry: %+v", got)
+	}
+	if err := reloaded.Remove(entry.ID); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if entries, _ := reloaded.List(); len(entries) != 0 {
+		t.Fatalf("expected no entries after remove, got: %+v", entries)
+	}
+}
@@ -0,0 +1,61 @@
+package gradeOutbox
+
+import (
+	"sort"
+	"sync"
+)
+
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+// NewMemoryStore creates a Store that keeps entries in memory, they are lost when the process exits
+func NewMemoryStore() Store {
+	return &memoryStore{entries: make(map[string]Entry)}
+}
+
+func (s *memoryStore) Save(entry Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[entry.ID] = entry
+	return nil
+}
+
+func (s *memoryStore) Get(id string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, exists := s.entries[id]
+	if !exists {
+		return nil, ErrEntryNotFound
+	}
+	return &entry, nil
+}
+
+func (s *memoryStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, id)
+	return nil
+}
+
+func (s *memoryStore) List() ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedEntries(s.entries), nil
+}
+
+// sortedEntries returns the entries oldest first
+func sortedEntries(entries map[string]Entry) []Entry {
+	list := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
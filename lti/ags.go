@@ -1,67 +1,174 @@
 package lti
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"github.com/GRT/lti-1-3-go-library/ltiCache"
 	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
 	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/pkg/errors"
-
-	jwt "github.com/dgrijalva/jwt-go"
 )
 
 const (
-	scopeKey         = "scope"
-	scoreScopeKey    = "https://purl.imsglobal.org/spec/lti-ags/scope/score"
-	lineItemScopeKey = "https://purl.imsglobal.org/spec/lti-ags/scope/lineitem"
-	minScore         = 0
+	scoreScopeKey            = "https://purl.imsglobal.org/spec/lti-ags/scope/score"
+	lineItemScopeKey         = "https://purl.imsglobal.org/spec/lti-ags/scope/lineitem"
+	lineItemReadonlyScopeKey = "https://purl.imsglobal.org/spec/lti-ags/scope/lineitem.readonly"
+	resultScopeKey           = "https://purl.imsglobal.org/spec/lti-ags/scope/result.readonly"
+	lineItemMediaType        = "application/vnd.ims.lis.v2.lineitem+json"
+	lineItemsMediaType       = "application/vnd.ims.lis.v2.lineitemcontainer+json"
+	scoreMediaType           = "application/vnd.ims.lis.v1.score+json"
+	minScore                 = 0
+	// the number of scores PutGrades posts at once, unless set in its options
+	defaultPutGradesConcurrency = 4
 )
 
 // AssignmentsGradeService offers the endpoints as specified in lti13
 type AssignmentsGradeService struct {
 	svcConn *ServiceConnector
-	svcData *jwt.MapClaims
+	svcData *AgsEndpointClaim
 }
 
 // LineItem represents a resource's item which can be assigned and graded
 type LineItem struct {
-	ID            string    `json:"id"`
-	ScoreMax      int       `json:"scoreMaximum"`
-	Label         string    `json:"label"`
-	ResourceID    string    `json:"resourceid"`
-	Tag           string    `json:"tag"`
-	StartDateTime time.Time `json:"startDateTime"`
-	EndDateTime   time.Time `json:"endDateTime"`
+	ID             string     `json:"id,omitempty"`
+	ScoreMax       float64    `json:"scoreMaximum"`
+	Label          string     `json:"label"`
+	ResourceID     string     `json:"resourceId,omitempty"`
+	ResourceLinkID string     `json:"resourceLinkId,omitempty"`
+	Tag            string     `json:"tag,omitempty"`
+	StartDateTime  *time.Time `json:"startDateTime,omitempty"`
+	EndDateTime    *time.Time `json:"endDateTime,omitempty"`
+}
+
+// LineItemsOptions are the (optional) filters for ListLineItems
+type LineItemsOptions struct {
+	ResourceLinkID string
+	ResourceID     string
+	Tag            string
+	// Limit is the page size asked of the platform, all pages are still fetched
+	Limit int
 }
 
-// Grade contains attributes for a grade
-type Grade struct {
-	ScoreGiven       int       `json:"scoreGiven"`
-	ScoreMax         int       `json:"scoreMaximum"`
-	ActivityProgress int       `json:"activityProgress"`
-	GradingProgress  int       `json:"gradingProgress"`
-	Timestamp        time.Time `json:"timestamp"`
-	UserID           string    `json:"userId"`
+// ActivityProgress is the user's progress on the line item's activity
+type ActivityProgress string
+
+// The activity progress values defined by the AGS spec
+const (
+	ActivityInitialized ActivityProgress = "Initialized"
+	ActivityStarted     ActivityProgress = "Started"
+	ActivityInProgress  ActivityProgress = "InProgress"
+	ActivitySubmitted   ActivityProgress = "Submitted"
+	ActivityCompleted   ActivityProgress = "Completed"
+)
+
+// GradingProgress is the state of the grading of the user's activity
+type GradingProgress string
+
+// The grading progress values defined by the AGS spec
+const (
+	GradingFullyGraded   GradingProgress = "FullyGraded"
+	GradingPending       GradingProgress = "Pending"
+	GradingPendingManual GradingProgress = "PendingManual"
+	GradingFailed        GradingProgress = "Failed"
+	GradingNotReady      GradingProgress = "NotReady"
+)
+
+// Score is a score published to the platform for a user, as specified by the AGS score service.
+// ScoreGiven and ScoreMaximum are pointers, since a score may be sent without a grade (eg: to record progress only).
+type Score struct {
+	UserID           string           `json:"userId"`
+	ScoreGiven       *float64         `json:"scoreGiven,omitempty"`
+	ScoreMaximum     *float64         `json:"scoreMaximum,omitempty"`
+	Comment          string           `json:"comment,omitempty"`
+	ActivityProgress ActivityProgress `json:"activityProgress"`
+	GradingProgress  GradingProgress  `json:"gradingProgress"`
+	// Timestamp is set to the current time when the score is sent, if it isn't set
+	Timestamp  time.Time        `json:"timestamp"`
+	Submission *ScoreSubmission `json:"submission,omitempty"`
+}
+
+// ScoreSubmission holds when the user started and submitted the work being scored
+type ScoreSubmission struct {
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	SubmittedAt *time.Time `json:"submittedAt,omitempty"`
+}
+
+// NewScore creates a completed, fully graded score for the user
+func NewScore(userID string, scoreGiven, scoreMaximum float64) Score {
+	return Score{
+		UserID:           userID,
+		ScoreGiven:       &scoreGiven,
+		ScoreMaximum:     &scoreMaximum,
+		ActivityProgress: ActivityCompleted,
+		GradingProgress:  GradingFullyGraded,
+	}
+}
+
+// Validate checks the score has the fields the spec requires
+func (s Score) Validate() error {
+	if s.UserID == "" {
+		return fmt.Errorf("score is missing the userId")
+	}
+	if s.ActivityProgress == "" || s.GradingProgress == "" {
+		return fmt.Errorf("score for user %q is missing activityProgress or gradingProgress", s.UserID)
+	}
+	if s.ScoreGiven != nil {
+		if s.ScoreMaximum == nil || *s.ScoreMaximum <= 0 {
+			return fmt.Errorf("score for user %q has a scoreGiven without a positive scoreMaximum", s.UserID)
+		}
+		if *s.ScoreGiven < minScore {
+			return fmt.Errorf("score for user %q has a negative scoreGiven", s.UserID)
+		}
+	}
+	return nil
 }
 
 // Result contains attributes about a particular users grade
 type Result struct {
-	UserID        string `json:"userId"`
-	ResultScore   string `json:"resultScore"`
-	ResultMaximum int    `json:"resultMaximum"`
-	Comment       string `json:"comment"`
-	ID            string `json:"id"`
-	ScoreOf       string `json:"scoreOf"`
+	ID            string   `json:"id"`
+	ScoreOf       string   `json:"scoreOf"`
+	UserID        string   `json:"userId"`
+	ResultScore   *float64 `json:"resultScore,omitempty"`
+	ResultMaximum *float64 `json:"resultMaximum,omitempty"`
+	Comment       string   `json:"comment,omitempty"`
+}
+
+// ResultsOptions are the (optional) filters for GetResults
+type ResultsOptions struct {
+	// UserID limits the results to the given user
+	UserID string
+	// Limit is the page size asked of the platform, all pages are still fetched
+	Limit int
+}
+
+// PutGradesOptions control how PutGrades sends scores
+type PutGradesOptions struct {
+	// Concurrency is the most scores posted at once (default 4)
+	Concurrency int
+	// Limiter limits the score posts to the platform, across every PutGrades call given the same limiter.
+	// Nil means no limit.
+	Limiter *RateLimiter
+}
+
+// PutGradeReport is the outcome of posting one of the scores given to PutGrades
+type PutGradeReport struct {
+	UserID string
+	// Result is the platform's result, if it returned one
+	Result *Result
+	Err    error
 }
 
 // NewAssignmentsGradeService creates a new AGS with (JWT) data from the claim
-func NewAssignmentsGradeService(conn *ServiceConnector, data *jwt.MapClaims) *AssignmentsGradeService {
+func NewAssignmentsGradeService(conn *ServiceConnector, data *AgsEndpointClaim) *AssignmentsGradeService {
 	return &AssignmentsGradeService{svcConn: conn, svcData: data}
 }
 
@@ -80,9 +187,9 @@ func AgsPutGradeHandlerCreator(registrationDS registrationDatastore.Registration
 				http.Error(w, "missing userId param", 400)
 				return
 			}
-			score, err := strconv.Atoi(req.FormValue("score"))
+			score, err := strconv.ParseFloat(req.FormValue("score"), 64)
 			if err != nil || score < minScore || score > lineitem.ScoreMax {
-				http.Error(w, fmt.Sprintf("score param must be present and between %d and %d", minScore, lineitem.ScoreMax), 400)
+				http.Error(w, fmt.Sprintf("score param must be present and between %d and %g", minScore, lineitem.ScoreMax), 400)
 				return
 			}
 
@@ -97,8 +204,7 @@ func AgsPutGradeHandlerCreator(registrationDS registrationDatastore.Registration
 				http.Error(w, err.Error(), 404)
 				return
 			}
-			grade := Grade{ScoreGiven: score, ScoreMax: lineitem.ScoreMax, UserID: userID}
-			res, err := svc.PutGrade(grade, lineitem)
+			res, err := svc.PutGrade(req.Context(), NewScore(userID, score, lineitem.ScoreMax), lineitem)
 			if err != nil {
 				http.Error(w, err.Error(), 500)
 				return
@@ -143,7 +249,7 @@ func AgsGetGradesHandlerCreator(registrationDS registrationDatastore.Registratio
 				http.Error(w, err.Error(), 404)
 				return
 			}
-			res, err := svc.GetGrades(lineitem)
+			res, err := svc.GetResults(req.Context(), lineitem, nil)
 			if err != nil {
 				http.Error(w, err.Error(), 500)
 				return
@@ -170,11 +276,17 @@ func AgsGetGradesHandlerCreator(registrationDS registrationDatastore.Registratio
 // ----------------------------------------------------------------------------
 // Instance Public
 
-// PutGrade is an lti1.3 specified AGS call.  It records the given grade against the given line item.
-// If the line item is nil, then a default one is created.
-func (s *AssignmentsGradeService) PutGrade(grade Grade, pLineItem *LineItem) (*Result, error) {
+// PutGrade is an lti1.3 specified AGS call.  It records the given score against the given line item.
+// If the line item is nil, then a default one is created.  The result is nil if the platform doesn't return one.
+func (s *AssignmentsGradeService) PutGrade(ctx context.Context, score Score, pLineItem *LineItem) (*Result, error) {
 	log.Printf("PutGrade called, svcData: %+v", s.svcData)
 	var scoreURL string
+	if err := score.Validate(); err != nil {
+		return nil, err
+	}
+	if score.Timestamp.IsZero() {
+		score.Timestamp = time.Now()
+	}
 	inscope, err := s.hasScope(scoreScopeKey)
 	if err != nil {
 		return nil, errors.Wrap(err, "PutGrade failure due to inability to fetch scope")
@@ -182,40 +294,100 @@ func (s *AssignmentsGradeService) PutGrade(grade Grade, pLineItem *LineItem) (*R
 		return nil, fmt.Errorf("missing scope: %q", scoreScopeKey)
 	}
 
-	if pLineItem != nil && pLineItem.ID == "" {
-		lineitem, err := s.findOrCreateLineItem(pLineItem)
-		if err != nil {
-			return nil, errors.Wrap(err, "PutGrade failed to find or create lineitem from existing lineitem")
-		}
-		scoreURL = lineitem.ID
-		log.Printf("Score url retrieved from existing lineitem (%+v), value: %q", pLineItem, scoreURL)
-	} else if pLineItem == nil && (*s.svcData)["lineitem"] != nil {
-		scoreURL = (*s.svcData)["lineitem"].(string)
-		log.Printf("Score url retrieved from svcData, value: %q", scoreURL)
-	} else {
-		li := createDefaultLineItem()
-		lineitem, err := s.findOrCreateLineItem(li)
-		if err != nil {
-			return nil, errors.Wrap(err, "PutGrade failed to find or create the lineitem from default")
-		}
-		scoreURL = lineitem.ID
-		log.Printf("Score url retrieved from default lineitem (%+v), value: %q", li, scoreURL)
+	scoreURL, err = s.resolveLineItemID(ctx, pLineItem)
+	if err != nil {
+		return nil, errors.Wrap(err, "PutGrade failed to find or create the lineitem")
+	}
+	scoreURL, err = lineItemServiceURL(scoreURL, "scores")
+	if err != nil {
+		return nil, err
 	}
-	scoreURL = fmt.Sprintf("%s/scores", scoreURL)
 	log.Printf("Final score url: %s", scoreURL)
+	return s.postScore(ctx, scoreURL, score)
+}
+
+// PutGrades records many scores against the given line item (resolved as for PutGrade, but only once).  The scores
+// are posted concurrently and rate limited, as set in opts.  The returned reports are in the same order
+// as the scores; an error is only returned if no score could be sent (eg: missing scope, or no line item).  Scores not
+// yet posted when the context is done are reported with the context's error.
+func (s *AssignmentsGradeService) PutGrades(ctx context.Context, pLineItem *LineItem, scores []Score, opts *PutGradesOptions) ([]PutGradeReport, error) {
+	concurrency := defaultPutGradesConcurrency
+	var limiter *RateLimiter
+	if opts != nil {
+		if opts.Concurrency > 0 {
+			concurrency = opts.Concurrency
+		}
+		limiter = opts.Limiter
+	}
+	inscope, err := s.hasScope(scoreScopeKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "PutGrades failure due to inability to fetch scope")
+	} else if !inscope {
+		return nil, fmt.Errorf("missing scope: %q", scoreScopeKey)
+	}
+	lineItemID, err := s.resolveLineItemID(ctx, pLineItem)
+	if err != nil {
+		return nil, errors.Wrap(err, "PutGrades failed to find or create the lineitem")
+	}
+	scoreURL, err := lineItemServiceURL(lineItemID, "scores")
+	if err != nil {
+		return nil, err
+	}
 
-	jsonBodyBytes, err := json.Marshal(grade)
+	now := time.Now()
+	reports := make([]PutGradeReport, len(scores))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				score := scores[i]
+				reports[i].UserID = score.UserID
+				if err := score.Validate(); err != nil {
+					reports[i].Err = err
+					continue
+				}
+				if score.Timestamp.IsZero() {
+					score.Timestamp = now
+				}
+				if limiter != nil {
+					if reports[i].Err = limiter.Wait(ctx); reports[i].Err != nil {
+						continue
+					}
+				}
+				reports[i].Result, reports[i].Err = s.postScore(ctx, scoreURL, score)
+			}
+		}()
+	}
+	for i := range scores {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return reports, nil
+}
+
+func (s *AssignmentsGradeService) postScore(ctx context.Context, scoreURL string, score Score) (*Result, error) {
+	jsonBodyBytes, err := json.Marshal(score)
 	if err != nil {
 		return nil, errors.Wrap(err, "PutGrade json failure")
 	}
 
-	res, err := s.svcConn.DoServiceRequest(s.getScopes(), scoreURL, "POST", string(jsonBodyBytes), "application/vnd.ims.lis.v1.score+json", "")
+	// not Idempotent: platforms need only reject scores older than the last, a retry with the same timestamp could be
+	// recorded twice, so the post is only retried if it wasn't sent
+	res, err := s.svcConn.Do(ctx, ServiceRequest{Method: "POST", URL: scoreURL, Scopes: s.getScopes(), Body: string(jsonBodyBytes), ContentType: scoreMediaType})
 	if err != nil {
 		return nil, errors.Wrap(err, "Failure executing service request for put grades")
 	}
 	log.Printf("put grades service request result: %+v", res)
 
+	// platforms commonly answer with no content
 	var retval *Result
+	if strings.TrimSpace(res.Body) == "" {
+		return nil, nil
+	}
 	err = json.Unmarshal([]byte(res.Body), &retval)
 	if err != nil {
 		return nil, errors.Wrap(err, "put grade failed to create json from response")
@@ -224,56 +396,216 @@ func (s *AssignmentsGradeService) PutGrade(grade Grade, pLineItem *LineItem) (*R
 }
 
 // GetGrades is an lti1.3 specified AGS call.  It returns the results of grades for the given line item.
-// If the line item is nil, then a default one is assumed and created, if necessary.
+// If the line item is nil, then a default one is assumed and created, if necessary.  Use GetResults to pass a context.
 func (s *AssignmentsGradeService) GetGrades(pLineItem *LineItem) ([]Result, error) {
-	lineitem, err := s.findOrCreateLineItem(pLineItem)
+	return s.GetResults(context.Background(), pLineItem, nil)
+}
+
+// GetResults is an lti1.3 specified AGS call.  It returns the results for the given line item, optionally filtered,
+// following the platform's paging links.  Use ForEachResult to avoid holding every result in memory.
+func (s *AssignmentsGradeService) GetResults(ctx context.Context, pLineItem *LineItem, opts *ResultsOptions) ([]Result, error) {
+	results := make([]Result, 0)
+	err := s.ForEachResult(ctx, pLineItem, opts, func(result Result) error {
+		results = append(results, result)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ForEachResult calls fn for each of the line item's results, a page at a time.  Paging stops if the context is done
+// or fn returns an error, and that error is returned.
+func (s *AssignmentsGradeService) ForEachResult(ctx context.Context, pLineItem *LineItem, opts *ResultsOptions, fn func(Result) error) error {
+	inscope, err := s.hasScope(resultScopeKey)
+	if err != nil {
+		return errors.Wrap(err, "GetResults failure due to inability to fetch scope")
+	} else if !inscope {
+		return fmt.Errorf("missing scope: %q", resultScopeKey)
+	}
+	lineItemID, err := s.resolveLineItemID(ctx, pLineItem)
+	if err != nil {
+		return errors.Wrap(err, "GetResults failed to find or create lineitem")
+	}
+	resultURL, err := lineItemServiceURL(lineItemID, "results")
+	if err != nil {
+		return err
+	}
+	params := url.Values{}
+	if opts != nil {
+		if opts.UserID != "" {
+			params.Set("user_id", opts.UserID)
+		}
+		if opts.Limit > 0 {
+			params.Set("limit", strconv.Itoa(opts.Limit))
+		}
+	}
+	if resultURL, err = addQueryParams(resultURL, params); err != nil {
+		return err
+	}
+
+	for count := 1; resultURL != ""; count++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		log.Printf("get results url: %s", resultURL)
+		res, err := s.svcConn.Do(ctx, ServiceRequest{URL: resultURL, Scopes: s.getScopes(), Accept: "application/vnd.ims.lis.v2.resultcontainer+json"})
+		if err != nil {
+			return errors.Wrapf(err, "Failure executing service request for get results, fetch #%d", count)
+		}
+		var page []Result
+		if err := json.Unmarshal([]byte(res.Body), &page); err != nil {
+			return errors.Wrapf(err, "get results failed to create json from response, fetch #%d", count)
+		}
+		for _, result := range page {
+			if err := fn(result); err != nil {
+				return err
+			}
+		}
+		resultURL = res.Link("next")
+	}
+	return nil
+}
+
+// ListLineItems is an lti1.3 specified AGS call.  It returns the line items of the launch's context, optionally filtered,
+// following the platform's paging links.
+func (s *AssignmentsGradeService) ListLineItems(ctx context.Context, opts *LineItemsOptions) ([]LineItem, error) {
+	if err := s.requireLineItemScope(true); err != nil {
+		return nil, err
+	}
+	if s.svcData.LineItems == "" {
+		return nil, fmt.Errorf("no lineitems url in AGS service data")
+	}
+	params := url.Values{}
+	if opts != nil {
+		if opts.ResourceLinkID != "" {
+			params.Set("resource_link_id", opts.ResourceLinkID)
+		}
+		if opts.ResourceID != "" {
+			params.Set("resource_id", opts.ResourceID)
+		}
+		if opts.Tag != "" {
+			params.Set("tag", opts.Tag)
+		}
+		if opts.Limit > 0 {
+			params.Set("limit", strconv.Itoa(opts.Limit))
+		}
+	}
+	lineitemsURL, err := addQueryParams(s.svcData.LineItems, params)
+	if err != nil {
+		return nil, err
+	}
+
+	lineitems := make([]LineItem, 0)
+	for count := 1; lineitemsURL != ""; count++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		log.Printf("calling GET on lineitems url: %q", lineitemsURL)
+		res, err := s.doLineItemRequest(ctx, ServiceRequest{Method: "GET", URL: lineitemsURL, Accept: lineItemsMediaType})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to fetch lineitems, fetch #%d", count)
+		}
+		var page []LineItem
+		if err := json.Unmarshal([]byte(res.Body), &page); err != nil {
+			return nil, errors.Wrapf(err, "Failed to process lineitems, fetch #%d", count)
+		}
+		lineitems = append(lineitems, page...)
+		lineitemsURL = res.Link("next")
+	}
+	return lineitems, nil
+}
+
+// GetLineItem is an lti1.3 specified AGS call.  It fetches the line item with the given id (its url).
+func (s *AssignmentsGradeService) GetLineItem(ctx context.Context, lineItemID string) (*LineItem, error) {
+	if err := s.requireLineItemScope(true); err != nil {
+		return nil, err
+	}
+	res, err := s.doLineItemRequest(ctx, ServiceRequest{Method: "GET", URL: lineItemID, Accept: lineItemMediaType})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch lineitem")
+	}
+	var lineitem *LineItem
+	if err := json.Unmarshal([]byte(res.Body), &lineitem); err != nil {
+		return nil, errors.Wrap(err, "Failed to process lineitem")
+	}
+	return lineitem, nil
+}
+
+// CreateLineItem is an lti1.3 specified AGS call.  It adds a line item to the launch's context and returns it
+// as created by the platform (with its id).
+func (s *AssignmentsGradeService) CreateLineItem(ctx context.Context, pLineItem *LineItem) (*LineItem, error) {
+	if err := s.requireLineItemScope(false); err != nil {
+		return nil, err
+	}
+	bodyBytes, err := json.Marshal(pLineItem)
 	if err != nil {
-		return nil, errors.Wrap(err, "GetGrades failed to find or create lineitem")
+		return nil, fmt.Errorf("Failed to serialize lineitem for sending")
 	}
-	resultURL := fmt.Sprintf("%s/results", lineitem.ID)
-	log.Printf("get grades result url: %s", resultURL)
+	log.Printf("calling POST on lineitems url: %q with body: %q", s.svcData.LineItems, string(bodyBytes))
 
-	res, err := s.svcConn.DoServiceRequest(s.getScopes(), resultURL, "GET", "", "", "application/vnd.ims.lis.v2.resultcontainer+json")
+	res, err := s.doLineItemRequest(ctx, ServiceRequest{Method: "POST", URL: s.svcData.LineItems, Body: string(bodyBytes), ContentType: lineItemMediaType, Accept: lineItemMediaType})
 	if err != nil {
-		return nil, errors.Wrap(err, "Failure executing service request for get grades")
+		return nil, errors.Wrap(err, "Failed to create new lineitem (1)")
 	}
-	log.Printf("get grades service request result: %+v", res)
+	log.Printf("result from lineitem post: %+v", res)
+	var newLineItem *LineItem
+	if err := json.Unmarshal([]byte(res.Body), &newLineItem); err != nil {
+		log.Printf("Error during unmarshall: %+v", err)
+		return nil, errors.Wrap(err, "failed to create new lineitem (2)")
+	}
+	return newLineItem, nil
+}
 
-	var resList []Result
-	err = json.Unmarshal([]byte(res.Body), &resList)
+// UpdateLineItem is an lti1.3 specified AGS call.  It replaces the line item (identified by its ID) and returns
+// the platform's updated version.
+func (s *AssignmentsGradeService) UpdateLineItem(ctx context.Context, pLineItem *LineItem) (*LineItem, error) {
+	if err := s.requireLineItemScope(false); err != nil {
+		return nil, err
+	}
+	if pLineItem.ID == "" {
+		return nil, fmt.Errorf("UpdateLineItem requires a lineitem id")
+	}
+	bodyBytes, err := json.Marshal(pLineItem)
 	if err != nil {
-		return nil, errors.Wrap(err, "get grades failed to create json from response")
+		return nil, fmt.Errorf("Failed to serialize lineitem for sending")
+	}
+	res, err := s.doLineItemRequest(ctx, ServiceRequest{Method: "PUT", URL: pLineItem.ID, Body: string(bodyBytes), ContentType: lineItemMediaType, Accept: lineItemMediaType})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to update lineitem")
+	}
+	var updated *LineItem
+	if err := json.Unmarshal([]byte(res.Body), &updated); err != nil {
+		return nil, errors.Wrap(err, "Failed to process updated lineitem")
 	}
+	return updated, nil
+}
 
-	return resList, nil
+// DeleteLineItem is an lti1.3 specified AGS call.  It removes the line item with the given id (its url).
+func (s *AssignmentsGradeService) DeleteLineItem(ctx context.Context, lineItemID string) error {
+	if err := s.requireLineItemScope(false); err != nil {
+		return err
+	}
+	if _, err := s.doLineItemRequest(ctx, ServiceRequest{Method: "DELETE", URL: lineItemID}); err != nil {
+		return errors.Wrap(err, "Failed to delete lineitem")
+	}
+	return nil
 }
 
 // ----------------------------------------------------------------------------
 // Instance Private
 
-func (s *AssignmentsGradeService) findOrCreateLineItem(pLineItem *LineItem) (*LineItem, error) {
+func (s *AssignmentsGradeService) findOrCreateLineItem(ctx context.Context, pLineItem *LineItem) (*LineItem, error) {
 	log.Printf("findOrCreateLineItem: %+v", pLineItem)
-	inscope, err := s.hasScope(lineItemScopeKey)
-	if err != nil {
-		return nil, errors.Wrapf(err, "Find/Create Lineitem failure due to inability to fetch scope: %q", lineItemScopeKey)
-	} else if !inscope {
-		return nil, fmt.Errorf("missing scope: %q", lineItemScopeKey)
-	}
-
-	lineitemsURL := (*s.svcData)["lineitems"].(string)
-	log.Printf("calling GET on lineitems url: %q", lineitemsURL)
-	res, err := s.svcConn.DoServiceRequest(s.getScopes(), lineitemsURL, "", "", "", "application/vnd.ims.lis.v2.lineitemcontainer+json")
+	existingLineitems, err := s.ListLineItems(ctx, &LineItemsOptions{Tag: pLineItem.Tag})
 	if err != nil {
 		return nil, errors.Wrap(err, "Failure fetching existing lineitems")
 	}
-	log.Printf("lineitems initial lookup result: %+v", res)
 
 	// find lineitem in existing list from provider,
 	// if it exists, return it (tag should equal pLineItem.Tag if it's the same)
-	var existingLineitems []LineItem
-	if err := json.Unmarshal([]byte(res.Body), &existingLineitems); err != nil {
-		return nil, errors.Wrap(err, "Failed to process lineitems")
-	}
+	// the platform may ignore the tag filter, so check it here too
 	for _, li := range existingLineitems {
 		if li.Tag == pLineItem.Tag {
 			log.Printf("Found lineitem amongst existing, returning: %+v", li)
@@ -282,23 +614,65 @@ func (s *AssignmentsGradeService) findOrCreateLineItem(pLineItem *LineItem) (*Li
 	}
 
 	// since we didn't find one, create it and return it
-	bodyBytes, err := json.Marshal(pLineItem)
+	return s.CreateLineItem(ctx, pLineItem)
+}
+
+// resolveLineItemID returns the id (url) of the line item to use: the given line item's, the launch's own
+// line item when none is given, otherwise the given (or default) line item is found or created by tag
+func (s *AssignmentsGradeService) resolveLineItemID(ctx context.Context, pLineItem *LineItem) (string, error) {
+	if lineItemID := s.knownLineItemID(pLineItem); lineItemID != "" {
+		return lineItemID, nil
+	}
+	li := pLineItem
+	if li == nil {
+		li = createDefaultLineItem()
+	}
+	lineitem, err := s.findOrCreateLineItem(ctx, li)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to serialize lineitem for sending")
+		return "", err
+	}
+	log.Printf("lineitem url retrieved from lineitem (%+v), value: %q", li, lineitem.ID)
+	return lineitem.ID, nil
+}
+
+// knownLineItemID returns the id of the line item to use if it is known without asking the platform: the given line
+// item's, or the launch's own line item when none is given.  It returns "" if the line item must be found or created.
+func (s *AssignmentsGradeService) knownLineItemID(pLineItem *LineItem) string {
+	if pLineItem != nil && pLineItem.ID != "" {
+		return pLineItem.ID
+	}
+	if pLineItem == nil && s.svcData.LineItem != "" {
+		log.Printf("lineitem url retrieved from svcData, value: %q", s.svcData.LineItem)
+		return s.svcData.LineItem
 	}
-	log.Printf("calling POST on lineitems url: %q with body: %q", lineitemsURL, string(bodyBytes))
+	return ""
+}
 
-	res, err = s.svcConn.DoServiceRequest(s.getScopes(), lineitemsURL, "POST", string(bodyBytes), "application/vnd.ims.lis.v2.lineitem+json", "application/vnd.ims.lis.v2.lineitem+json")
+func (s *AssignmentsGradeService) requireLineItemScope(readOnly bool) error {
+	inscope, err := s.hasScope(lineItemScopeKey)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to create new lineitem (1)")
+		return errors.Wrapf(err, "Lineitem failure due to inability to fetch scope: %q", lineItemScopeKey)
 	}
-	log.Printf("result from lineitem post: %+v", res)
-	var newLineItem *LineItem
-	if err := json.Unmarshal([]byte(res.Body), &newLineItem); err != nil {
-		log.Printf("Error during unmarshall: %+v", err)
-		return nil, errors.Wrap(err, "failed to create new lineitem (2)")
+	if inscope {
+		return nil
 	}
-	return newLineItem, nil
+	if readOnly {
+		if inscope, _ := s.hasScope(lineItemReadonlyScopeKey); inscope {
+			return nil
+		}
+		return fmt.Errorf("missing scope: %q or %q", lineItemScopeKey, lineItemReadonlyScopeKey)
+	}
+	return fmt.Errorf("missing scope: %q", lineItemScopeKey)
+}
+
+// doLineItemRequest makes the request with the AGS scopes
+func (s *AssignmentsGradeService) doLineItemRequest(ctx context.Context, svcReq ServiceRequest) (*ServiceResult, error) {
+	svcReq.Scopes = s.getScopes()
+	res, err := s.svcConn.Do(ctx, svcReq)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failure executing %s lineitem request", svcReq.Method)
+	}
+	return res, nil
 }
 
 func (s *AssignmentsGradeService) hasScope(pScope string) (bool, error) {
@@ -307,8 +681,7 @@ func (s *AssignmentsGradeService) hasScope(pScope string) (bool, error) {
 		return false, fmt.Errorf("missing scopes in AGS service data")
 	}
 	for _, val := range scopes {
-		valStr := fmt.Sprint(val)
-		if pScope == valStr {
+		if pScope == val {
 			return true, nil
 		}
 	}
@@ -316,22 +689,43 @@ func (s *AssignmentsGradeService) hasScope(pScope string) (bool, error) {
 }
 
 func (s *AssignmentsGradeService) getScopes() []string {
-	scopes, ok := (*s.svcData)[scopeKey].([]interface{})
-	if !ok {
+	if s.svcData.Scope == nil {
 		return make([]string, 0)
 	}
-	return stringSlicify(scopes)
+	return s.svcData.Scope
 }
 
 // ----------------------------------------------------------------------------
 // Helpers
 
-func stringSlicify(t []interface{}) []string {
-	s := make([]string, len(t))
-	for i, v := range t {
-		s[i] = fmt.Sprint(v)
+// lineItemServiceURL returns the url of a line item's scores or results service, keeping any query string
+// of the line item id after the added path
+func lineItemServiceURL(lineItemID, service string) (string, error) {
+	u, err := url.Parse(lineItemID)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to parse lineitem id: %q", lineItemID)
+	}
+	u.Path = fmt.Sprintf("%s/%s", strings.TrimSuffix(u.Path, "/"), service)
+	return u.String(), nil
+}
+
+// addQueryParams adds params to a url that may already have a query string
+func addQueryParams(rawURL string, params url.Values) (string, error) {
+	if len(params) == 0 {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to parse url: %q", rawURL)
+	}
+	q := u.Query()
+	for k, vals := range params {
+		for _, v := range vals {
+			q.Add(k, v)
+		}
 	}
-	return s
+	u.RawQuery = q.Encode()
+	return u.String(), nil
 }
 
 func createDefaultLineItem() *LineItem {
@@ -0,0 +1,170 @@
+package lti
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GRT/lti-1-3-go-library/gradeOutbox"
+	"github.com/GRT/lti-1-3-go-library/ltiCache"
+	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+// QueueGrade validates the score and persists it to the outbox, rather than posting it straight away.
+// The outbox sends it (retrying if the platform is unavailable) using OutboxSender.  Queuing doesn't call the
+// platform: a line item without an id is found or created (by tag) when the score is sent.
+func (s *AssignmentsGradeService) QueueGrade(outbox *gradeOutbox.Outbox, score Score, pLineItem *LineItem) (*gradeOutbox.Entry, error) {
+	if err := score.Validate(); err != nil {
+		return nil, err
+	}
+	if score.Timestamp.IsZero() {
+		score.Timestamp = time.Now()
+	}
+	inscope, err := s.hasScope(scoreScopeKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "QueueGrade failure due to inability to fetch scope")
+	} else if !inscope {
+		return nil, fmt.Errorf("missing scope: %q", scoreScopeKey)
+	}
+	scoreBytes, err := json.Marshal(score)
+	if err != nil {
+		return nil, errors.Wrap(err, "QueueGrade json failure")
+	}
+	entry := gradeOutbox.Entry{
+		Issuer:   s.svcConn.registration.Issuer,
+		ClientID: s.svcConn.registration.ClientID,
+		Scopes:   s.getScopes(),
+		UserID:   score.UserID,
+		Score:    scoreBytes,
+	}
+	if lineItemID := s.knownLineItemID(pLineItem); lineItemID != "" {
+		if entry.ScoreURL, err = lineItemServiceURL(lineItemID, "scores"); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := s.requireLineItemScope(true); err != nil {
+			return nil, errors.Wrap(err, "QueueGrade can't find the lineitem")
+		}
+		if s.svcData.LineItems == "" {
+			return nil, fmt.Errorf("no lineitems url in AGS service data")
+		}
+		li := pLineItem
+		if li == nil {
+			li = createDefaultLineItem()
+		}
+		if entry.LineItem, err = json.Marshal(li); err != nil {
+			return nil, errors.Wrap(err, "QueueGrade json failure")
+		}
+		entry.LineItemsURL = s.svcData.LineItems
+	}
+	return outbox.Enqueue(entry)
+}
+
+// OutboxSender returns the gradeOutbox.Sender that posts queued scores to the platform of the entry's issuer and client id.
+// Platform rejections (ServiceErrors that aren't Retryable) are permanent, everything else is retried.
+func OutboxSender(registrationDS registrationDatastore.RegistrationDatastore) gradeOutbox.Sender {
+	return func(ctx context.Context, entry gradeOutbox.Entry) error {
+		reg, err := registrationDS.FindRegistrationByClientID(entry.Issuer, entry.ClientID)
+		if err != nil {
+			return gradeOutbox.Permanent(errors.Wrapf(err, "no registration for issuer %q and client id %q", entry.Issuer, entry.ClientID))
+		}
+		// the outbox does its own retrying
+		svcConn := NewServiceConnector(*reg).WithRetryPolicy(ServiceRetryPolicy{})
+		scoreURL := entry.ScoreURL
+		if scoreURL == "" {
+			if scoreURL, err = outboxScoreURL(ctx, svcConn, entry); err != nil {
+				return outboxSendError(errors.Wrapf(err, "Error finding the lineitem for user %q", entry.UserID))
+			}
+		}
+		_, err = svcConn.Do(ctx, ServiceRequest{Method: "POST", URL: scoreURL, Scopes: entry.Scopes, Body: string(entry.Score), ContentType: scoreMediaType})
+		if err == nil {
+			return nil
+		}
+		return outboxSendError(errors.Wrapf(err, "Error posting score for user %q", entry.UserID))
+	}
+}
+
+// outboxScoreURL finds or creates the line item of an entry queued without its id, returning its scores url
+func outboxScoreURL(ctx context.Context, svcConn *ServiceConnector, entry gradeOutbox.Entry) (string, error) {
+	var lineitem LineItem
+	if err := json.Unmarshal(entry.LineItem, &lineitem); err != nil {
+		return "", gradeOutbox.Permanent(errors.Wrap(err, "Failed to parse the queued lineitem"))
+	}
+	svc := NewAssignmentsGradeService(svcConn, &AgsEndpointClaim{Scope: entry.Scopes, LineItems: entry.LineItemsURL})
+	lineItemID, err := svc.resolveLineItemID(ctx, &lineitem)
+	if err != nil {
+		return "", err
+	}
+	return lineItemServiceURL(lineItemID, "scores")
+}
+
+// outboxSendError makes err permanent if the platform rejected the request, otherwise the outbox retries it
+func outboxSendError(err error) error {
+	var svcErr *ServiceError
+	if errors.As(err, &svcErr) && !svcErr.Retryable {
+		return gradeOutbox.Permanent(err)
+	}
+	return err
+}
+
+// AgsQueueGradeHandlerCreator returns a function which creates an http.Handler that uses a cached LTI Message launch's assessment grade service
+// to queue a grade in the outbox.  The grade is persisted before the response is written; the outbox sends it to the platform.
+// Expected method: Get, params: score, userId, launchId
+func AgsQueueGradeHandlerCreator(registrationDS registrationDatastore.RegistrationDatastore, cache ltiCache.Cache, store sessions.Store, sessionName string, debug bool, pLineItem *LineItem, outbox *gradeOutbox.Outbox) func(http.Handler) http.Handler {
+	lineitem := pLineItem
+	if pLineItem == nil {
+		lineitem = createDefaultLineItem()
+	}
+	return func(handla http.Handler) http.Handler {
+		handlerFunc := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			userID := req.FormValue("userId")
+			if userID == "" {
+				http.Error(w, "missing userId param", 400)
+				return
+			}
+			score, err := strconv.ParseFloat(req.FormValue("score"), 64)
+			if err != nil || score < minScore || score > lineitem.ScoreMax {
+				http.Error(w, fmt.Sprintf("score param must be present and between %d and %g", minScore, lineitem.ScoreMax), 400)
+				return
+			}
+
+			msgLaunch, err := NewMessageLaunchFromCache(req.FormValue("launchId"), req, registrationDS, cache, store, sessionName, debug)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			svc, err := msgLaunch.GetAgs()
+			if err != nil {
+				// could be an error or maybe the launch context doesn't provide ags
+				http.Error(w, err.Error(), 404)
+				return
+			}
+			entry, err := svc.QueueGrade(outbox, NewScore(userID, score, lineitem.ScoreMax), lineitem)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			log.Printf("grade queued for user %q, outbox entry: %q", userID, entry.ID)
+			b, err := json.Marshal(entry)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			w.Write(b)
+			// Invoke the passed in handler if it's there
+			if handla != nil {
+				handla.ServeHTTP(w, req)
+			}
+		})
+		return handlerFunc
+	}
+}
@@ -0,0 +1,364 @@
+package lti_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GRT/lti-1-3-go-library/gradeOutbox"
+	"github.com/GRT/lti-1-3-go-library/lti"
+)
+
+// newTestPlatform starts a platform that hands out access tokens on /token and passes every other request to handler.
+// The returned connector uses the test registration, pointed at the platform's token endpoint.
+func newTestPlatform(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *lti.ServiceConnector) {
+	platform := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token": "test-token", "token_type": "Bearer", "expires_in": 3600}`)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer test-token" {
+			http.Error(w, "missing access token", 401)
+			return
+		}
+		handler(w, req)
+	}))
+	reg := getTestRegistration(t)
+	reg.AuthTokenURL = platform.URL + "/token"
+	return platform, lti.NewServiceConnector(*reg)
+}
+
+func TestLineItemCRUD(t *testing.T) {
+	deleted := false
+	var platform *httptest.Server
+	platform, conn := newTestPlatform(t, func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/lineitems" && req.Method == "GET" && req.URL.Query().Get("page") == "":
+			if req.URL.Query().Get("resource_link_id") != "rl1" || req.URL.Query().Get("limit") != "1" {
+				http.Error(w, "filters not passed", 400)
+				return
+			}
+			w.Header().Set("Link", fmt.Sprintf(`<%s/lineitems?page=2>; rel="next"`, platform.URL))
+			fmt.Fprintf(w, `[{"id": "%s/lineitems/1", "label": "One", "scoreMaximum": 10, "resourceLinkId": "rl1"}]`, platform.URL)
+		case req.URL.Path == "/lineitems" && req.Method == "GET":
+			fmt.Fprintf(w, `[{"id": "%s/lineitems/2", "label": "Two", "scoreMaximum": 20, "resourceLinkId": "rl1"}]`, platform.URL)
+		case req.URL.Path == "/lineitems" && req.Method == "POST":
+			var li lti.LineItem
+			json.NewDecoder(req.Body).Decode(&li)
+			li.ID = platform.URL + "/lineitems/3"
+			json.NewEncoder(w).Encode(li)
+		case req.URL.Path == "/lineitems/3" && req.Method == "GET":
+			fmt.Fprintf(w, `{"id": "%s/lineitems/3", "label": "Three", "scoreMaximum": 30}`, platform.URL)
+		case req.URL.Path == "/lineitems/3" && req.Method == "PUT":
+			body, _ := ioutil.ReadAll(req.Body)
+			w.Write(body)
+		case req.URL.Path == "/lineitems/3" && req.Method == "DELETE":
+			deleted = true
+			w.WriteHeader(204)
+		default:
+			http.NotFound(w, req)
+		}
+	})
+	defer platform.Close()
+
+	ctx := context.Background()
+	readonly := lti.NewAssignmentsGradeService(conn, &lti.AgsEndpointClaim{
+		Scope:     []string{"https://purl.imsglobal.org/spec/lti-ags/scope/lineitem.readonly"},
+		LineItems: platform.URL + "/lineitems",
+	})
+	lineitems, err := readonly.ListLineItems(ctx, &lti.LineItemsOptions{ResourceLinkID: "rl1", Limit: 1})
+	if err != nil {
+		t.Fatalf("ListLineItems failed: %v", err)
+	}
+	if len(lineitems) != 2 || lineitems[1].Label != "Two" {
+		t.Fatalf("expected both pages of lineitems, got: %+v", lineitems)
+	}
+	if _, err := readonly.CreateLineItem(ctx, &lti.LineItem{Label: "Three"}); err == nil {
+		t.Fatalf("creating a lineitem with only the readonly scope should fail")
+	}
+
+	svc := lti.NewAssignmentsGradeService(conn, &lti.AgsEndpointClaim{
+		Scope:     []string{"https://purl.imsglobal.org/spec/lti-ags/scope/lineitem"},
+		LineItems: platform.URL + "/lineitems",
+	})
+	created, err := svc.CreateLineItem(ctx, &lti.LineItem{Label: "Three", ScoreMax: 30, Tag: "three"})
+	if err != nil {
+		t.Fatalf("CreateLineItem failed: %v", err)
+	}
+	if created.ID != platform.URL+"/lineitems/3" {
+		t.Fatalf("unexpected created lineitem: %+v", created)
+	}
+	fetched, err := svc.GetLineItem(ctx, created.ID)
+	if err != nil || fetched.ScoreMax != 30 {
+		t.Fatalf("GetLineItem failed: %+v, %v", fetched, err)
+	}
+	fetched.Label = "Three (renamed)"
+	updated, err := svc.UpdateLineItem(ctx, fetched)
+	if err != nil || updated.Label != "Three (renamed)" {
+		t.Fatalf("UpdateLineItem failed: %+v, %v", updated, err)
+	}
+	if err := svc.DeleteLineItem(ctx, created.ID); err != nil || !deleted {
+		t.Fatalf("DeleteLineItem failed: %v", err)
+	}
+	if err := svc.DeleteLineItem(ctx, platform.URL+"/lineitems/404"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("deleting a missing lineitem should fail with the status, got: %v", err)
+	}
+}
+
+func TestPutGradeScore(t *testing.T) {
+	var posted map[string]interface{}
+	var contentType string
+	platform, conn := newTestPlatform(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/lineitems/1/scores" || req.URL.Query().Get("type") != "graded" {
+			http.NotFound(w, req)
+			return
+		}
+		contentType = req.Header.Get("Content-Type")
+		json.NewDecoder(req.Body).Decode(&posted)
+		w.WriteHeader(204)
+	})
+	defer platform.Close()
+
+	ctx := context.Background()
+	svc := lti.NewAssignmentsGradeService(conn, &lti.AgsEndpointClaim{
+		Scope:    []string{"https://purl.imsglobal.org/spec/lti-ags/scope/score"},
+		LineItem: platform.URL + "/lineitems/1?type=graded",
+	})
+	if _, err := svc.PutGrade(ctx, lti.Score{UserID: "user1"}, nil); err == nil {
+		t.Fatalf("a score without progress should be rejected")
+	}
+	score := lti.NewScore("user1", 7.5, 10)
+	score.Comment = "Nice work"
+	res, err := svc.PutGrade(ctx, score, nil)
+	if err != nil {
+		t.Fatalf("PutGrade failed: %v", err)
+	}
+	if res != nil {
+		t.Fatalf("expected no result for a 204 response, got: %+v", res)
+	}
+	if contentType != "application/vnd.ims.lis.v1.score+json" {
+		t.Fatalf("unexpected score content type: %q", contentType)
+	}
+	if posted["scoreGiven"] != 7.5 || posted["scoreMaximum"] != 10.0 || posted["activityProgress"] != "Completed" ||
+		posted["gradingProgress"] != "FullyGraded" || posted["comment"] != "Nice work" {
+		t.Fatalf("unexpected score posted: %v", posted)
+	}
+	if ts, _ := posted["timestamp"].(string); ts == "" || strings.HasPrefix(ts, "0001") {
+		t.Fatalf("the score timestamp should be set automatically, got: %v", posted["timestamp"])
+	}
+}
+
+func TestGetResultsPaging(t *testing.T) {
+	var platform *httptest.Server
+	platform, conn := newTestPlatform(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/lineitems/1/results" || req.URL.Query().Get("limit") != "2" {
+			http.NotFound(w, req)
+			return
+		}
+		userID := req.URL.Query().Get("user_id")
+		switch page := req.URL.Query().Get("page"); {
+		case userID != "":
+			fmt.Fprintf(w, `[{"userId": %q, "resultScore": 8.5, "resultMaximum": 10}]`, userID)
+		case page == "":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/lineitems/1/results?limit=2&page=2>; rel="next"`, platform.URL))
+			fmt.Fprint(w, `[{"userId": "u1", "resultScore": 1}, {"userId": "u2", "resultScore": 2}]`)
+		default:
+			fmt.Fprint(w, `[{"userId": "u3", "resultScore": 3}]`)
+		}
+	})
+	defer platform.Close()
+
+	ctx := context.Background()
+	svc := lti.NewAssignmentsGradeService(conn, &lti.AgsEndpointClaim{
+		Scope:    []string{"https://purl.imsglobal.org/spec/lti-ags/scope/result.readonly"},
+		LineItem: platform.URL + "/lineitems/1",
+	})
+	results, err := svc.GetResults(ctx, nil, &lti.ResultsOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("GetResults failed: %v", err)
+	}
+	if len(results) != 3 || results[2].UserID != "u3" || *results[2].ResultScore != 3 {
+		t.Fatalf("expected the results of both pages, got: %+v", results)
+	}
+
+	results, err = svc.GetResults(ctx, nil, &lti.ResultsOptions{UserID: "u9", Limit: 2})
+	if err != nil || len(results) != 1 || results[0].UserID != "u9" || *results[0].ResultScore != 8.5 {
+		t.Fatalf("expected the single user's result, got: %+v, %v", results, err)
+	}
+
+	// stopping early doesn't fetch the next page
+	stop := fmt.Errorf("stop")
+	seen := 0
+	err = svc.ForEachResult(ctx, nil, &lti.ResultsOptions{Limit: 2}, func(result lti.Result) error {
+		seen++
+		return stop
+	})
+	if err != stop || seen != 1 {
+		t.Fatalf("expected ForEachResult to stop after the first result, seen: %d, err: %v", seen, err)
+	}
+}
+
+func TestPutGrades(t *testing.T) {
+	var mu sync.Mutex
+	posted := make(map[string]float64)
+	lineitemLists := 0
+	var platform *httptest.Server
+	platform, conn := newTestPlatform(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/lineitems":
+			mu.Lock()
+			lineitemLists++
+			mu.Unlock()
+			fmt.Fprintf(w, `[{"id": "%s/lineitems/1", "label": "Bulk", "scoreMaximum": 10, "tag": "bulk"}]`, platform.URL)
+		case "/lineitems/1/scores":
+			var score lti.Score
+			json.NewDecoder(req.Body).Decode(&score)
+			if score.UserID == "bad" {
+				http.Error(w, "unknown user", 422)
+				return
+			}
+			mu.Lock()
+			posted[score.UserID] = *score.ScoreGiven
+			mu.Unlock()
+			w.WriteHeader(204)
+		default:
+			http.NotFound(w, req)
+		}
+	})
+	defer platform.Close()
+
+	ctx := context.Background()
+	svc := lti.NewAssignmentsGradeService(conn, &lti.AgsEndpointClaim{
+		Scope:     []string{"https://purl.imsglobal.org/spec/lti-ags/scope/score", "https://purl.imsglobal.org/spec/lti-ags/scope/lineitem"},
+		LineItems: platform.URL + "/lineitems",
+	})
+	scores := make([]lti.Score, 0)
+	for i := 0; i < 10; i++ {
+		scores = append(scores, lti.NewScore(fmt.Sprintf("u%d", i), float64(i), 10))
+	}
+	scores = append(scores, lti.NewScore("bad", 1, 10), lti.Score{UserID: "invalid"})
+
+	start := time.Now()
+	limiter := lti.NewRateLimiter(50)
+	reports, err := svc.PutGrades(ctx, &lti.LineItem{Tag: "bulk", Label: "Bulk", ScoreMax: 10}, scores, &lti.PutGradesOptions{Concurrency: 3, Limiter: limiter})
+	if err != nil {
+		t.Fatalf("PutGrades failed: %v", err)
+	}
+	// 11 posts at 50 a second take at least 200ms
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Fatalf("score posts were not rate limited, took: %v", elapsed)
+	}
+	if lineitemLists != 1 {
+		t.Fatalf("the lineitem should be resolved once, was listed %d times", lineitemLists)
+	}
+	if len(reports) != len(scores) {
+		t.Fatalf("expected a report per score, got %d", len(reports))
+	}
+	for i, report := range reports[:10] {
+		if report.Err != nil || report.UserID != scores[i].UserID || posted[report.UserID] != float64(i) {
+			t.Fatalf("unexpected report for %q: %+v", scores[i].UserID, report)
+		}
+	}
+	if reports[10].Err == nil || !strings.Contains(reports[10].Err.Error(), "422") {
+		t.Fatalf("expected the platform's rejection in the report, got: %+v", reports[10])
+	}
+	if reports[11].Err == nil {
+		t.Fatalf("an invalid score should be reported without being posted")
+	}
+
+	// calls sharing a limiter are limited together
+	start = time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			svc.PutGrades(ctx, &lti.LineItem{ID: platform.URL + "/lineitems/1"}, scores[:3], &lti.PutGradesOptions{Limiter: limiter})
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("score posts sharing the limiter should be limited to 50 a second, took: %v", elapsed)
+	}
+
+	// scores not posted before the context is done are reported with its error
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	reports, err = svc.PutGrades(cancelled, &lti.LineItem{ID: platform.URL + "/lineitems/1"}, scores[:3], &lti.PutGradesOptions{Limiter: lti.NewRateLimiter(50)})
+	if err != nil {
+		t.Fatalf("PutGrades failed: %v", err)
+	}
+	for _, report := range reports {
+		if !errors.Is(report.Err, context.Canceled) {
+			t.Fatalf("expected the cancelled score posts to fail with context.Canceled, got: %+v", report)
+		}
+	}
+}
+
+func TestQueueGradeOffline(t *testing.T) {
+	var mu sync.Mutex
+	down := true
+	requests := make([]string, 0)
+	var platform *httptest.Server
+	platform, conn := newTestPlatform(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		switch {
+		case down:
+			http.Error(w, "unavailable", 503)
+		case req.URL.Path == "/lineitems" && req.Method == "GET":
+			fmt.Fprint(w, `[]`)
+		case req.URL.Path == "/lineitems" && req.Method == "POST":
+			var li lti.LineItem
+			json.NewDecoder(req.Body).Decode(&li)
+			li.ID = platform.URL + "/lineitems/7"
+			json.NewEncoder(w).Encode(li)
+		case req.URL.Path == "/lineitems/7/scores" && req.Method == "POST":
+			w.WriteHeader(204)
+		default:
+			http.NotFound(w, req)
+		}
+	})
+	defer platform.Close()
+	reg := getTestRegistration(t)
+	reg.AuthTokenURL = platform.URL + "/token"
+	outbox := gradeOutbox.NewOutbox(gradeOutbox.NewMemoryStore(), lti.OutboxSender(&memoryRegistrationDS{reg: *reg}), gradeOutbox.RetryPolicy{MaxAttempts: 3})
+
+	// the line item only has a tag, it's found or created when the score is sent
+	svc := lti.NewAssignmentsGradeService(conn, &lti.AgsEndpointClaim{
+		Scope:     []string{"https://purl.imsglobal.org/spec/lti-ags/scope/score", "https://purl.imsglobal.org/spec/lti-ags/scope/lineitem"},
+		LineItems: platform.URL + "/lineitems",
+	})
+	entry, err := svc.QueueGrade(outbox, lti.NewScore("u1", 5, 10), &lti.LineItem{Tag: "quiz", Label: "Quiz", ScoreMax: 10})
+	if err != nil {
+		t.Fatalf("QueueGrade should persist the score while the platform is down, got: %v", err)
+	}
+	if len(requests) != 0 || entry.ScoreURL != "" {
+		t.Fatalf("QueueGrade should not call the platform, requests: %v", requests)
+	}
+	if n, _ := outbox.ProcessDue(context.Background()); n != 0 {
+		t.Fatalf("expected the send to fail while the platform is down")
+	}
+
+	mu.Lock()
+	down = false
+	requests = requests[:0]
+	mu.Unlock()
+	outbox.Replay(entry.ID)
+	if n, err := outbox.ProcessDue(context.Background()); n != 1 || err != nil {
+		t.Fatalf("expected the score to be sent, got: %d, %v", n, err)
+	}
+	if strings.Join(requests, ",") != "GET /lineitems,POST /lineitems,POST /lineitems/7/scores" {
+		t.Fatalf("expected the lineitem to be created before the score was posted, requests: %v", requests)
+	}
+}
@@ -0,0 +1,349 @@
+package lti
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/GRT/lti-1-3-go-library/ltiCache"
+	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	"github.com/segmentio/ksuid"
+)
+
+const (
+	deepLinkResponseMessageType = "LtiDeepLinkingResponse"
+	// how long (in seconds) the deep link response jwt is valid for
+	deepLinkResponseLifetime = 300
+	deepLinkFormTemplateStr  = `<html><head></head><body>
+	<form id="auto_submit" action="{{.ReturnURL}}" method="POST">
+		<input type="hidden" name="JWT" value="{{.JWT}}" />
+	</form>
+	<script>
+		document.getElementById('auto_submit').submit();
+	</script>
+</body></html>`
+)
+
+var deepLinkFormTemplate = template.Must(template.New("deepLinkForm").Parse(deepLinkFormTemplateStr))
+
+// DeepLinkingSettings holds the deep_linking_settings claim sent with an LtiDeepLinkingRequest launch
+type DeepLinkingSettings struct {
+	DeepLinkReturnURL                 string   `json:"deep_link_return_url"`
+	AcceptTypes                       []string `json:"accept_types"`
+	AcceptPresentationDocumentTargets []string `json:"accept_presentation_document_targets"`
+	AcceptMediaTypes                  string   `json:"accept_media_types,omitempty"`
+	AcceptMultiple                    bool     `json:"accept_multiple,omitempty"`
+	AutoCreate                        bool     `json:"auto_create,omitempty"`
+	Title                             string   `json:"title,omitempty"`
+	Text                              string   `json:"text,omitempty"`
+	Data                              string   `json:"data,omitempty"`
+}
+
+// AcceptsType returns true if the platform accepts content items of the given type
+func (s DeepLinkingSettings) AcceptsType(itemType string) bool {
+	for _, t := range s.AcceptTypes {
+		if t == itemType {
+			return true
+		}
+	}
+	return false
+}
+
+// DeepLinkContentItem is implemented by each of the content item types that can be returned to the platform
+type DeepLinkContentItem interface {
+	// ItemType returns the content item type as named in the deep linking spec (eg: "ltiResourceLink")
+	ItemType() string
+}
+
+// DeepLinkIcon is an icon or thumbnail for a content item
+type DeepLinkIcon struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+}
+
+// DeepLinkWindow describes how a content item should be opened in a new window
+type DeepLinkWindow struct {
+	TargetName     string `json:"targetName,omitempty"`
+	Width          int    `json:"width,omitempty"`
+	Height         int    `json:"height,omitempty"`
+	WindowFeatures string `json:"windowFeatures,omitempty"`
+}
+
+// DeepLinkIframe describes how a content item should be embedded in an iframe
+type DeepLinkIframe struct {
+	Src    string `json:"src,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+}
+
+// DeepLinkEmbed holds html used to embed a link content item
+type DeepLinkEmbed struct {
+	HTML string `json:"html"`
+}
+
+// DeepLinkLineItem asks the platform to create a line item for an ltiResourceLink
+type DeepLinkLineItem struct {
+	Label        string  `json:"label,omitempty"`
+	ScoreMaximum float64 `json:"scoreMaximum"`
+	ResourceID   string  `json:"resourceId,omitempty"`
+	Tag          string  `json:"tag,omitempty"`
+}
+
+// DeepLinkTimeWindow is a start/end date range (used for availability and submission)
+type DeepLinkTimeWindow struct {
+	StartDateTime *time.Time `json:"startDateTime,omitempty"`
+	EndDateTime   *time.Time `json:"endDateTime,omitempty"`
+}
+
+// DeepLinkResourceLink is an ltiResourceLink content item
+type DeepLinkResourceLink struct {
+	URL        string              `json:"url,omitempty"`
+	Title      string              `json:"title,omitempty"`
+	Text       string              `json:"text,omitempty"`
+	Icon       *DeepLinkIcon       `json:"icon,omitempty"`
+	Thumbnail  *DeepLinkIcon       `json:"thumbnail,omitempty"`
+	Window     *DeepLinkWindow     `json:"window,omitempty"`
+	Iframe     *DeepLinkIframe     `json:"iframe,omitempty"`
+	Custom     map[string]string   `json:"custom,omitempty"`
+	LineItem   *DeepLinkLineItem   `json:"lineItem,omitempty"`
+	Available  *DeepLinkTimeWindow `json:"available,omitempty"`
+	Submission *DeepLinkTimeWindow `json:"submission,omitempty"`
+}
+
+// DeepLinkLink is a link content item (a plain url hosted elsewhere)
+type DeepLinkLink struct {
+	URL       string          `json:"url"`
+	Title     string          `json:"title,omitempty"`
+	Text      string          `json:"text,omitempty"`
+	Icon      *DeepLinkIcon   `json:"icon,omitempty"`
+	Thumbnail *DeepLinkIcon   `json:"thumbnail,omitempty"`
+	Embed     *DeepLinkEmbed  `json:"embed,omitempty"`
+	Window    *DeepLinkWindow `json:"window,omitempty"`
+	Iframe    *DeepLinkIframe `json:"iframe,omitempty"`
+}
+
+// DeepLinkFile is a file content item
+type DeepLinkFile struct {
+	URL       string        `json:"url"`
+	Title     string        `json:"title,omitempty"`
+	Text      string        `json:"text,omitempty"`
+	Icon      *DeepLinkIcon `json:"icon,omitempty"`
+	Thumbnail *DeepLinkIcon `json:"thumbnail,omitempty"`
+	MediaType string        `json:"mediaType,omitempty"`
+	ExpiresAt *time.Time    `json:"expiresAt,omitempty"`
+}
+
+// DeepLinkHTML is an html fragment content item
+type DeepLinkHTML struct {
+	HTML  string `json:"html"`
+	Title string `json:"title,omitempty"`
+	Text  string `json:"text,omitempty"`
+}
+
+// DeepLinkImage is an image content item
+type DeepLinkImage struct {
+	URL       string        `json:"url"`
+	Title     string        `json:"title,omitempty"`
+	Text      string        `json:"text,omitempty"`
+	Icon      *DeepLinkIcon `json:"icon,omitempty"`
+	Thumbnail *DeepLinkIcon `json:"thumbnail,omitempty"`
+	Width     int           `json:"width,omitempty"`
+	Height    int           `json:"height,omitempty"`
+}
+
+// ItemType returns "ltiResourceLink"
+func (i DeepLinkResourceLink) ItemType() string { return "ltiResourceLink" }
+
+// ItemType returns "link"
+func (i DeepLinkLink) ItemType() string { return "link" }
+
+// ItemType returns "file"
+func (i DeepLinkFile) ItemType() string { return "file" }
+
+// ItemType returns "html"
+func (i DeepLinkHTML) ItemType() string { return "html" }
+
+// ItemType returns "image"
+func (i DeepLinkImage) ItemType() string { return "image" }
+
+// MarshalJSON adds the type attribute to the serialized content item
+func (i DeepLinkResourceLink) MarshalJSON() ([]byte, error) {
+	type item DeepLinkResourceLink
+	return json.Marshal(struct {
+		Type string `json:"type"`
+		item
+	}{i.ItemType(), item(i)})
+}
+
+// MarshalJSON adds the type attribute to the serialized content item
+func (i DeepLinkLink) MarshalJSON() ([]byte, error) {
+	type item DeepLinkLink
+	return json.Marshal(struct {
+		Type string `json:"type"`
+		item
+	}{i.ItemType(), item(i)})
+}
+
+// MarshalJSON adds the type attribute to the serialized content item
+func (i DeepLinkFile) MarshalJSON() ([]byte, error) {
+	type item DeepLinkFile
+	return json.Marshal(struct {
+		Type string `json:"type"`
+		item
+	}{i.ItemType(), item(i)})
+}
+
+// MarshalJSON adds the type attribute to the serialized content item
+func (i DeepLinkHTML) MarshalJSON() ([]byte, error) {
+	type item DeepLinkHTML
+	return json.Marshal(struct {
+		Type string `json:"type"`
+		item
+	}{i.ItemType(), item(i)})
+}
+
+// MarshalJSON adds the type attribute to the serialized content item
+func (i DeepLinkImage) MarshalJSON() ([]byte, error) {
+	type item DeepLinkImage
+	return json.Marshal(struct {
+		Type string `json:"type"`
+		item
+	}{i.ItemType(), item(i)})
+}
+
+// DeepLinkResponse builds the LtiDeepLinkingResponse message that is sent back to the platform
+// after the user has picked content in the tool.
+type DeepLinkResponse struct {
+	registration registrationDatastore.Registration
+	deploymentID string
+	settings     DeepLinkingSettings
+	// Message is an optional message the platform may show to the user once the response is processed
+	Message string
+	// Log is an optional message the platform may log once the response is processed
+	Log string
+	// ErrorMessage is an optional error message the platform may show to the user
+	ErrorMessage string
+	// ErrorLog is an optional error message the platform may log
+	ErrorLog string
+}
+
+// NewDeepLinkResponse creates a DeepLinkResponse for the given registration, deployment and deep linking settings
+func NewDeepLinkResponse(reg registrationDatastore.Registration, deploymentID string, settings DeepLinkingSettings) *DeepLinkResponse {
+	return &DeepLinkResponse{registration: reg, deploymentID: deploymentID, settings: settings}
+}
+
+// Settings returns the deep linking settings from the launch this response answers
+func (d *DeepLinkResponse) Settings() DeepLinkingSettings {
+	return d.settings
+}
+
+// GetResponseJWT returns the signed LtiDeepLinkingResponse jwt that contains the given content items
+func (d *DeepLinkResponse) GetResponseJWT(items []DeepLinkContentItem) (string, error) {
+	if len(items) > 1 && !d.settings.AcceptMultiple {
+		return "", fmt.Errorf("platform does not accept multiple content items (got %d)", len(items))
+	}
+	for _, item := range items {
+		if !d.settings.AcceptsType(item.ItemType()) {
+			return "", fmt.Errorf("platform does not accept content items of type %q", item.ItemType())
+		}
+	}
+	if items == nil {
+		items = make([]DeepLinkContentItem, 0)
+	}
+	now := time.Now().Unix()
+	claims := jwt.MapClaims{
+		"iss":             d.registration.ClientID,
+		"aud":             d.registration.Issuer,
+		"iat":             now,
+		"exp":             now + deepLinkResponseLifetime,
+		"nonce":           fmt.Sprintf("nonce-%s", ksuid.New().String()),
+		claimMessageType:  deepLinkResponseMessageType,
+		claimVersion:      "1.3.0",
+		claimDeploymentID: d.deploymentID,
+		"https://purl.imsglobal.org/spec/lti-dl/claim/content_items": items,
+	}
+	if d.settings.Data != "" {
+		claims["https://purl.imsglobal.org/spec/lti-dl/claim/data"] = d.settings.Data
+	}
+	if d.Message != "" {
+		claims["https://purl.imsglobal.org/spec/lti-dl/claim/msg"] = d.Message
+	}
+	if d.Log != "" {
+		claims["https://purl.imsglobal.org/spec/lti-dl/claim/log"] = d.Log
+	}
+	if d.ErrorMessage != "" {
+		claims["https://purl.imsglobal.org/spec/lti-dl/claim/errormsg"] = d.ErrorMessage
+	}
+	if d.ErrorLog != "" {
+		claims["https://purl.imsglobal.org/spec/lti-dl/claim/errorlog"] = d.ErrorLog
+	}
+	tokenStr, err := signWithToolKey(d.registration, claims)
+	if err != nil {
+		return "", errors.Wrap(err, "GetResponseJWT: failed to sign deep link response")
+	}
+	return tokenStr, nil
+}
+
+// OutputResponseForm writes an html page that auto-posts the signed deep link response to the platform's deep_link_return_url
+func (d *DeepLinkResponse) OutputResponseForm(w http.ResponseWriter, items []DeepLinkContentItem) error {
+	tokenStr, err := d.GetResponseJWT(items)
+	if err != nil {
+		return err
+	}
+	data := struct {
+		ReturnURL string
+		JWT       string
+	}{
+		ReturnURL: d.settings.DeepLinkReturnURL,
+		JWT:       tokenStr,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return deepLinkFormTemplate.Execute(w, data)
+}
+
+// DeepLinkItemsFunc returns the content items that the user picked for a deep link request
+type DeepLinkItemsFunc func(req *http.Request, settings DeepLinkingSettings) ([]DeepLinkContentItem, error)
+
+// DeepLinkResponseHandlerCreator returns a function which creates an http.Handler that uses a cached LTI Message launch
+// to answer a deep linking request with the content items returned by itemsFunc.
+// Expected method: Get or Post, params: launchId (plus any params itemsFunc needs)
+func DeepLinkResponseHandlerCreator(registrationDS registrationDatastore.RegistrationDatastore, cache ltiCache.Cache, store sessions.Store, sessionName string, debug bool, itemsFunc DeepLinkItemsFunc) func(http.Handler) http.Handler {
+	return func(handla http.Handler) http.Handler {
+		handlerFunc := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			msgLaunch, err := NewMessageLaunchFromCache(req.FormValue("launchId"), req, registrationDS, cache, store, sessionName, debug)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			dl, err := msgLaunch.GetDeepLinkResponse()
+			if err != nil {
+				// the launch was probably not a deep link request
+				http.Error(w, err.Error(), 404)
+				return
+			}
+			items, err := itemsFunc(req, dl.Settings())
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			if err := dl.OutputResponseForm(w, items); err != nil {
+				log.Printf("deep link response failed: %v", err)
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			// Invoke the passed in handler if it's there
+			if handla != nil {
+				handla.ServeHTTP(w, req)
+			}
+		})
+		return handlerFunc
+	}
+}
@@ -0,0 +1,83 @@
+package lti_test
+
+import (
+	"testing"
+
+	"github.com/GRT/lti-1-3-go-library/lti"
+	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	regJSONPath = "../registrationDatastore/registrations.json"
+	regIssuer   = "http://imsglobal.org"
+)
+
+func getTestRegistration(t *testing.T) *registrationDatastore.Registration {
+	ds, err := registrationDatastore.NewJsonRegistrationDatastore(regJSONPath)
+	if err != nil {
+		t.Fatalf("failed to create the json reg datastore: %v", err)
+	}
+	reg, err := ds.FindRegistration(regIssuer)
+	if err != nil {
+		t.Fatalf("failed to find registration for issuer %q: %v", regIssuer, err)
+	}
+	return reg
+}
+
+func TestDeepLinkResponseJWT(t *testing.T) {
+	reg := getTestRegistration(t)
+	settings := lti.DeepLinkingSettings{
+		DeepLinkReturnURL: "https://platform.example.com/deep_links",
+		AcceptTypes:       []string{"ltiResourceLink", "link"},
+		AcceptMultiple:    true,
+		Data:              "opaque-platform-data",
+	}
+	dl := lti.NewDeepLinkResponse(*reg, "dep1", settings)
+	items := []lti.DeepLinkContentItem{
+		lti.DeepLinkResourceLink{Title: "Chapter 1", URL: "https://tool.example.com/launch"},
+		lti.DeepLinkLink{Title: "Reading", URL: "https://example.com/reading"},
+	}
+	tokenStr, err := dl.GetResponseJWT(items)
+	if err != nil {
+		t.Fatalf("failed to create deep link response jwt: %v", err)
+	}
+
+	privkey, _ := jwt.ParseRSAPrivateKeyFromPEM([]byte(reg.ToolPrivateKey))
+	token, err := jwt.Parse(tokenStr, func(*jwt.Token) (interface{}, error) { return &privkey.PublicKey, nil })
+	if err != nil {
+		t.Fatalf("deep link response jwt failed verification: %v", err)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["iss"] != reg.ClientID || claims["aud"] != reg.Issuer {
+		t.Fatalf("unexpected iss/aud: %v/%v", claims["iss"], claims["aud"])
+	}
+	if claims["https://purl.imsglobal.org/spec/lti/claim/message_type"] != "LtiDeepLinkingResponse" {
+		t.Fatalf("unexpected message type: %v", claims["https://purl.imsglobal.org/spec/lti/claim/message_type"])
+	}
+	if claims["https://purl.imsglobal.org/spec/lti-dl/claim/data"] != settings.Data {
+		t.Fatalf("data claim was not echoed back")
+	}
+	contentItems, ok := claims["https://purl.imsglobal.org/spec/lti-dl/claim/content_items"].([]interface{})
+	if !ok || len(contentItems) != 2 {
+		t.Fatalf("expected 2 content items, got: %v", claims["https://purl.imsglobal.org/spec/lti-dl/claim/content_items"])
+	}
+	if first := contentItems[0].(map[string]interface{}); first["type"] != "ltiResourceLink" {
+		t.Fatalf("content item type missing, got: %v", first)
+	}
+}
+
+func TestDeepLinkResponseRejectsTypes(t *testing.T) {
+	reg := getTestRegistration(t)
+	settings := lti.DeepLinkingSettings{AcceptTypes: []string{"ltiResourceLink"}}
+	dl := lti.NewDeepLinkResponse(*reg, "dep1", settings)
+
+	if _, err := dl.GetResponseJWT([]lti.DeepLinkContentItem{lti.DeepLinkHTML{HTML: "<p>hi</p>"}}); err == nil {
+		t.Fatalf("html item should be rejected when the platform only accepts ltiResourceLink")
+	}
+	twoItems := []lti.DeepLinkContentItem{lti.DeepLinkResourceLink{Title: "a"}, lti.DeepLinkResourceLink{Title: "b"}}
+	if _, err := dl.GetResponseJWT(twoItems); err == nil {
+		t.Fatalf("multiple items should be rejected when accept_multiple is false")
+	}
+}
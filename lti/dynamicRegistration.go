@@ -0,0 +1,375 @@
+package lti
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	toolConfigurationKey     = "https://purl.imsglobal.org/spec/lti-tool-configuration"
+	platformConfigurationKey = "https://purl.imsglobal.org/spec/lti-platform-configuration"
+	// the page shown once registration is done, it asks the platform to close the registration window
+	registrationCompleteTemplateStr = `<html><head></head><body>
+	<p>Registration complete.</p>
+	<script>
+		(window.opener || window.parent).postMessage({subject: 'org.imsglobal.lti.close'}, '*');
+	</script>
+</body></html>`
+	dynamicRegistrationKeyBits = 2048
+)
+
+// ToolConfiguration describes the tool to the platform during LTI Dynamic Registration
+type ToolConfiguration struct {
+	ClientName       string
+	Description      string
+	LogoURI          string
+	InitiateLoginURI string
+	RedirectURIs     []string
+	// JwksURI is where the platform fetches the tool's keys, see JWKSHandler
+	JwksURI          string
+	TargetLinkURI    string
+	Domain           string
+	Scopes           []string
+	Claims           []string
+	CustomParameters map[string]string
+	Messages         []ToolConfigurationMessage
+	// AllowPlatform decides whether the registration request may register the tool with the platform whose openid
+	// configuration url is given, eg: by checking the url against a list of trusted platforms or authenticating the
+	// request.  The registration handler rejects every request if it is nil.
+	AllowPlatform func(req *http.Request, configURL *url.URL) bool
+}
+
+// ToolConfigurationMessage is a message (eg: LtiDeepLinkingRequest) the tool supports, beyond the default resource link launch
+type ToolConfigurationMessage struct {
+	Type             string            `json:"type"`
+	TargetLinkURI    string            `json:"target_link_uri,omitempty"`
+	Label            string            `json:"label,omitempty"`
+	IconURI          string            `json:"icon_uri,omitempty"`
+	CustomParameters map[string]string `json:"custom_parameters,omitempty"`
+	Placements       []string          `json:"placements,omitempty"`
+}
+
+// PlatformConfiguration is the platform's openid configuration, as fetched during dynamic registration
+type PlatformConfiguration struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JwksURI               string   `json:"jwks_uri"`
+	RegistrationEndpoint  string   `json:"registration_endpoint"`
+	ScopesSupported       []string `json:"scopes_supported,omitempty"`
+	PlatformConfiguration struct {
+		ProductFamilyCode string `json:"product_family_code"`
+		Version           string `json:"version"`
+	} `json:"https://purl.imsglobal.org/spec/lti-platform-configuration"`
+}
+
+type toolRegistrationRequest struct {
+	ApplicationType         string   `json:"application_type"`
+	ResponseTypes           []string `json:"response_types"`
+	GrantTypes              []string `json:"grant_types"`
+	InitiateLoginURI        string   `json:"initiate_login_uri"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	ClientName              string   `json:"client_name"`
+	JwksURI                 string   `json:"jwks_uri"`
+	LogoURI                 string   `json:"logo_uri,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	Scope                   string   `json:"scope,omitempty"`
+	ToolConfiguration       struct {
+		Domain           string                     `json:"domain"`
+		Description      string                     `json:"description,omitempty"`
+		TargetLinkURI    string                     `json:"target_link_uri"`
+		CustomParameters map[string]string          `json:"custom_parameters,omitempty"`
+		Claims           []string                   `json:"claims"`
+		Messages         []ToolConfigurationMessage `json:"messages"`
+	} `json:"https://purl.imsglobal.org/spec/lti-tool-configuration"`
+}
+
+type toolRegistrationResponse struct {
+	ClientID          string `json:"client_id"`
+	ToolConfiguration struct {
+		DeploymentID string `json:"deployment_id"`
+	} `json:"https://purl.imsglobal.org/spec/lti-tool-configuration"`
+}
+
+// DynamicRegistration performs the tool side of the 1EdTech LTI Dynamic Registration flow
+type DynamicRegistration struct {
+	regDS      registrationDatastore.WritableRegistrationDatastore
+	toolConfig ToolConfiguration
+	client     *http.Client
+}
+
+// defaultRegistrationClient only connects to public addresses, so registration requests can't be used to reach the
+// tool's internal network
+var defaultRegistrationClient = &http.Client{
+	Timeout: time.Second * 30,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: dialPublicOnly}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// NewDynamicRegistration creates a DynamicRegistration that saves new registrations into the given datastore
+func NewDynamicRegistration(registrationDS registrationDatastore.WritableRegistrationDatastore, toolConfig ToolConfiguration) *DynamicRegistration {
+	return &DynamicRegistration{regDS: registrationDS, toolConfig: toolConfig, client: defaultRegistrationClient}
+}
+
+// WithHTTPClient returns a copy of the DynamicRegistration that calls the platform with the given client.  The default
+// client refuses to connect to private and loopback addresses, a replacement should do the same.
+func (d *DynamicRegistration) WithHTTPClient(client *http.Client) *DynamicRegistration {
+	dr := *d
+	dr.client = client
+	return &dr
+}
+
+// DynamicRegistrationHandlerCreator returns a function which creates an http.Handler that handles the platform's
+// registration initiation request, registers the tool with the platform and stores the new registration.
+// Only platforms the tool configuration's AllowPlatform accepts can be registered.
+// Expected method: Get, params: openid_configuration, registration_token (optional)
+func DynamicRegistrationHandlerCreator(registrationDS registrationDatastore.WritableRegistrationDatastore, toolConfig ToolConfiguration) func(http.Handler) http.Handler {
+	return NewDynamicRegistration(registrationDS, toolConfig).HandlerCreator()
+}
+
+// HandlerCreator returns a function which creates an http.Handler that registers the tool using the DynamicRegistration,
+// see DynamicRegistrationHandlerCreator
+func (d *DynamicRegistration) HandlerCreator() func(http.Handler) http.Handler {
+	return func(handla http.Handler) http.Handler {
+		handlerFunc := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			configURL := req.FormValue("openid_configuration")
+			if configURL == "" {
+				http.Error(w, "missing openid_configuration param", 400)
+				return
+			}
+			parsedURL, err := url.Parse(configURL)
+			if err != nil || d.toolConfig.AllowPlatform == nil || !d.toolConfig.AllowPlatform(req, parsedURL) {
+				log.Printf("dynamic registration refused for openid configuration %q", configURL)
+				http.Error(w, "registration with this platform is not allowed", 403)
+				return
+			}
+			if _, err := d.Register(configURL, req.FormValue("registration_token")); err != nil {
+				// the error may describe the tool's network, so it is only logged
+				log.Printf("dynamic registration failed: %v", err)
+				http.Error(w, "registration with the platform failed", 502)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, registrationCompleteTemplateStr)
+			// Invoke the passed in handler if it's there
+			if handla != nil {
+				handla.ServeHTTP(w, req)
+			}
+		})
+		return handlerFunc
+	}
+}
+
+// Register fetches the platform's openid configuration, registers the tool at its registration endpoint
+// and saves the resulting registration (with a newly generated tool key).  Both urls must be https.
+func (d *DynamicRegistration) Register(configURL, registrationToken string) (*registrationDatastore.Registration, error) {
+	if !isHTTPS(configURL) {
+		return nil, fmt.Errorf("platform openid configuration url %q is not https", configURL)
+	}
+	platformConfig, err := d.fetchPlatformConfiguration(configURL)
+	if err != nil {
+		return nil, err
+	}
+	regResp, err := d.registerTool(platformConfig, registrationToken)
+	if err != nil {
+		return nil, err
+	}
+	toolKey, err := newToolKey()
+	if err != nil {
+		return nil, err
+	}
+	reg := registrationDatastore.Registration{
+		Issuer:       platformConfig.Issuer,
+		ClientID:     regResp.ClientID,
+		KeySetURL:    platformConfig.JwksURI,
+		AuthTokenURL: platformConfig.TokenEndpoint,
+		AuthLoginURL: platformConfig.AuthorizationEndpoint,
+		ToolKeys:     []registrationDatastore.ToolKey{*toolKey},
+	}
+	if depID := regResp.ToolConfiguration.DeploymentID; depID != "" {
+		reg.DeploymentIds = []string{depID}
+	}
+	// registration requests aren't authenticated, so they can only add registrations, never replace one
+	if err := d.regDS.AddRegistration(reg); err == registrationDatastore.ErrRegistrationExists {
+		return nil, fmt.Errorf("A registration already exists for issuer %q and clientId %q", reg.Issuer, reg.ClientID)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Failed to save the registration for issuer: %q", reg.Issuer)
+	}
+	log.Printf("dynamic registration saved for issuer %q, clientId %q", reg.Issuer, reg.ClientID)
+	return &reg, nil
+}
+
+func (d *DynamicRegistration) fetchPlatformConfiguration(configURL string) (*PlatformConfiguration, error) {
+	resp, err := d.client.Get(configURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch the platform openid configuration from %q", configURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("Error response fetching the platform openid configuration (%q)", resp.Status)
+	}
+	var cfg PlatformConfiguration
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the platform openid configuration")
+	}
+	// the issuer must be on the host the configuration was fetched from
+	if !sameOrigin(cfg.Issuer, configURL) {
+		return nil, fmt.Errorf("platform issuer %q does not match the openid configuration url %q", cfg.Issuer, configURL)
+	}
+	if cfg.RegistrationEndpoint == "" || cfg.AuthorizationEndpoint == "" || cfg.TokenEndpoint == "" || cfg.JwksURI == "" {
+		return nil, fmt.Errorf("platform openid configuration is missing required endpoints")
+	}
+	if !isHTTPS(cfg.RegistrationEndpoint) {
+		return nil, fmt.Errorf("platform registration endpoint %q is not https", cfg.RegistrationEndpoint)
+	}
+	return &cfg, nil
+}
+
+func (d *DynamicRegistration) registerTool(platformConfig *PlatformConfiguration, registrationToken string) (*toolRegistrationResponse, error) {
+	body := toolRegistrationRequest{
+		ApplicationType:         "web",
+		ResponseTypes:           []string{"id_token"},
+		GrantTypes:              []string{"implicit", "client_credentials"},
+		InitiateLoginURI:        d.toolConfig.InitiateLoginURI,
+		RedirectURIs:            d.toolConfig.RedirectURIs,
+		ClientName:              d.toolConfig.ClientName,
+		JwksURI:                 d.toolConfig.JwksURI,
+		LogoURI:                 d.toolConfig.LogoURI,
+		TokenEndpointAuthMethod: "private_key_jwt",
+		Scope:                   strings.Join(d.toolConfig.Scopes, " "),
+	}
+	body.ToolConfiguration.Domain = d.toolConfig.Domain
+	body.ToolConfiguration.Description = d.toolConfig.Description
+	body.ToolConfiguration.TargetLinkURI = d.toolConfig.TargetLinkURI
+	body.ToolConfiguration.CustomParameters = d.toolConfig.CustomParameters
+	body.ToolConfiguration.Claims = d.toolConfig.Claims
+	body.ToolConfiguration.Messages = d.toolConfig.Messages
+	if body.ToolConfiguration.Claims == nil {
+		body.ToolConfiguration.Claims = []string{"iss", "sub"}
+	}
+	if body.ToolConfiguration.Messages == nil {
+		body.ToolConfiguration.Messages = make([]ToolConfigurationMessage, 0)
+	}
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to serialize the tool configuration")
+	}
+
+	req, err := http.NewRequest("POST", platformConfig.RegistrationEndpoint, strings.NewReader(string(bodyBytes)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error creating the registration request to %q", platformConfig.RegistrationEndpoint)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+	if registrationToken != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", registrationToken))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error executing the registration request to %q", platformConfig.RegistrationEndpoint)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading the registration response")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("Error response from the platform registration endpoint (%q): %s", resp.Status, string(respBody))
+	}
+	var regResp toolRegistrationResponse
+	if err := json.Unmarshal(respBody, &regResp); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the registration response")
+	}
+	if regResp.ClientID == "" {
+		return nil, fmt.Errorf("platform registration response has no client_id")
+	}
+	return &regResp, nil
+}
+
+// sameOrigin returns true if both urls are absolute and have the same scheme and host (including the port)
+func sameOrigin(url1, url2 string) bool {
+	u1, err := url.Parse(url1)
+	if err != nil {
+		return false
+	}
+	u2, err := url.Parse(url2)
+	if err != nil {
+		return false
+	}
+	return u1.Host != "" && strings.EqualFold(u1.Scheme, u2.Scheme) && strings.EqualFold(u1.Host, u2.Host)
+}
+
+func isHTTPS(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Scheme, "https")
+}
+
+// privateNetworks are the address ranges registration requests may not connect to, besides loopback, link local
+// and unspecified addresses
+var privateNetworks = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+// dialPublicOnly refuses connections to private, loopback and link local addresses.  It checks the resolved address
+// being dialed, so a platform host name can't resolve to an internal address.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("refusing to connect to %q, not an ip address", address)
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("refusing to connect to non public address %q", address)
+	}
+	for _, private := range privateNetworks {
+		if private.Contains(ip) {
+			return fmt.Errorf("refusing to connect to private address %q", address)
+		}
+	}
+	return nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// newToolKey generates the signing key for a new registration
+func newToolKey() (*registrationDatastore.ToolKey, error) {
+	privkey, err := rsa.GenerateKey(rand.Reader, dynamicRegistrationKeyBits)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate a tool key")
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privkey)})
+	kid, err := registrationDatastore.KeyThumbprint(&privkey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &registrationDatastore.ToolKey{KeyID: kid, Status: registrationDatastore.ToolKeyActive, PrivateKey: string(pemBytes)}, nil
+}
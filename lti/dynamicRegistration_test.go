@@ -0,0 +1,168 @@
+package lti_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GRT/lti-1-3-go-library/lti"
+	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+)
+
+func TestDynamicRegistration(t *testing.T) {
+	var platform *httptest.Server
+	var registered map[string]interface{}
+	platform = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer": %q, "authorization_endpoint": "%s/auth", "token_endpoint": "%s/token", "jwks_uri": "%s/jwks", "registration_endpoint": "%s/register"}`,
+				platform.URL, platform.URL, platform.URL, platform.URL, platform.URL)
+		case "/register":
+			if req.Header.Get("Authorization") != "Bearer reg-token" {
+				http.Error(w, "bad registration token", 401)
+				return
+			}
+			json.NewDecoder(req.Body).Decode(&registered)
+			fmt.Fprint(w, `{"client_id": "dyn-client", "https://purl.imsglobal.org/spec/lti-tool-configuration": {"deployment_id": "dyn-dep"}}`)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer platform.Close()
+
+	dir, err := ioutil.TempDir("", "dynreg")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	jsonPath := filepath.Join(dir, "registrations.json")
+	if err := ioutil.WriteFile(jsonPath, []byte("[]"), 0600); err != nil {
+		t.Fatalf("failed to write registrations file: %v", err)
+	}
+	ds, err := registrationDatastore.NewWritableJsonRegistrationDatastore(jsonPath)
+	if err != nil {
+		t.Fatalf("failed to create the writable json reg datastore: %v", err)
+	}
+
+	toolConfig := lti.ToolConfiguration{
+		ClientName:       "Test Tool",
+		InitiateLoginURI: "https://tool.example.com/login",
+		RedirectURIs:     []string{"https://tool.example.com/launch"},
+		JwksURI:          "https://tool.example.com/jwks",
+		TargetLinkURI:    "https://tool.example.com/launch",
+		Domain:           "tool.example.com",
+	}
+	params := url.Values{"openid_configuration": {platform.URL + "/.well-known/openid-configuration"}, "registration_token": {"reg-token"}}
+
+	// platforms must be allowed by the tool configuration
+	rec := httptest.NewRecorder()
+	lti.NewDynamicRegistration(ds, toolConfig).WithHTTPClient(platform.Client()).HandlerCreator()(nil).
+		ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/register?"+params.Encode(), nil))
+	if rec.Code != 403 || registered != nil {
+		t.Fatalf("expected the registration to be refused without AllowPlatform, got: %d", rec.Code)
+	}
+	// the default client doesn't connect to loopback addresses, and the platform's errors aren't passed on
+	toolConfig.AllowPlatform = func(req *http.Request, configURL *url.URL) bool {
+		return configURL.Host == strings.TrimPrefix(platform.URL, "https://")
+	}
+	rec = httptest.NewRecorder()
+	lti.DynamicRegistrationHandlerCreator(ds, toolConfig)(nil).ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/register?"+params.Encode(), nil))
+	if rec.Code != 502 || registered != nil || strings.Contains(rec.Body.String(), "127.0.0.1") {
+		t.Fatalf("expected a generic failure registering with a loopback address, got: %d, %s", rec.Code, rec.Body.String())
+	}
+
+	handler := lti.NewDynamicRegistration(ds, toolConfig).WithHTTPClient(platform.Client()).HandlerCreator()(nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/register?"+params.Encode(), nil))
+	if rec.Code != 200 {
+		t.Fatalf("unexpected status from registration handler: %d, %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "org.imsglobal.lti.close") {
+		t.Fatalf("registration should finish with the close window message")
+	}
+	if registered["initiate_login_uri"] != "https://tool.example.com/login" || registered["https://purl.imsglobal.org/spec/lti-tool-configuration"] == nil {
+		t.Fatalf("unexpected tool configuration sent to the platform: %v", registered)
+	}
+
+	// the registration is persisted, so a fresh datastore over the same file sees it
+	reloaded, err := registrationDatastore.NewJsonRegistrationDatastore(jsonPath)
+	if err != nil {
+		t.Fatalf("failed to reload the json reg datastore: %v", err)
+	}
+	reg, err := reloaded.FindRegistration(platform.URL)
+	if err != nil {
+		t.Fatalf("registration was not saved: %v", err)
+	}
+	if reg.ClientID != "dyn-client" || reg.AuthTokenURL != platform.URL+"/token" {
+		t.Fatalf("unexpected registration saved: %+v", reg)
+	}
+	if dep, _ := reloaded.FindDeployment(platform.URL, "dyn-dep"); dep == nil {
+		t.Fatalf("deployment was not saved")
+	}
+	if _, err := reg.SigningKey(time.Now()); err != nil {
+		t.Fatalf("registration should have an active tool key: %v", err)
+	}
+}
+
+func TestDynamicRegistrationRejected(t *testing.T) {
+	var platform *httptest.Server
+	issuer := ""
+	platform = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer": %q, "authorization_endpoint": "%s/auth", "token_endpoint": "%s/token", "jwks_uri": "%s/jwks", "registration_endpoint": "%s/register"}`,
+				issuer, platform.URL, platform.URL, platform.URL, platform.URL)
+		case "/register":
+			fmt.Fprint(w, `{"client_id": "dyn-client"}`)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer platform.Close()
+
+	dir, err := ioutil.TempDir("", "dynreg")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	jsonPath := filepath.Join(dir, "registrations.json")
+	if err := ioutil.WriteFile(jsonPath, []byte("[]"), 0600); err != nil {
+		t.Fatalf("failed to write registrations file: %v", err)
+	}
+	ds, err := registrationDatastore.NewWritableJsonRegistrationDatastore(jsonPath)
+	if err != nil {
+		t.Fatalf("failed to create the writable json reg datastore: %v", err)
+	}
+	dr := lti.NewDynamicRegistration(ds, lti.ToolConfiguration{ClientName: "Test Tool"}).WithHTTPClient(platform.Client())
+	configURL := platform.URL + "/.well-known/openid-configuration"
+
+	// the platform must be https
+	issuer = platform.URL
+	if _, err := dr.Register("http"+strings.TrimPrefix(configURL, "https"), ""); err == nil {
+		t.Fatalf("expected an http openid configuration url to be rejected")
+	}
+
+	// the issuer must be on the configuration's host, not just a prefix of its url
+	for _, issuer = range []string{platform.URL[:len(platform.URL)-1], "http" + strings.TrimPrefix(platform.URL, "https"), "/"} {
+		if _, err := dr.Register(configURL, ""); err == nil {
+			t.Fatalf("expected issuer %q to be rejected for %q", issuer, configURL)
+		}
+	}
+
+	// an existing registration is never replaced
+	issuer = platform.URL
+	if _, err := dr.Register(configURL, ""); err != nil {
+		t.Fatalf("expected the registration to succeed, got: %v", err)
+	}
+	if _, err := dr.Register(configURL, ""); err == nil {
+		t.Fatalf("expected registering the same issuer and client id again to fail")
+	}
+}
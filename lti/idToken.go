@@ -0,0 +1,297 @@
+package lti
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+)
+
+// SupportedAlgorithms are the id_token signing algorithms a registration can allow
+var SupportedAlgorithms = []string{"RS256", "RS384", "RS512", "ES256", "PS256"}
+
+// defaultAlgorithms are allowed for registrations that don't list their own, RS256 is the algorithm the LTI security
+// framework requires platforms to support
+var defaultAlgorithms = []string{"RS256"}
+
+// id_token verification errors, use errors.Is to check for them
+var (
+	ErrTokenMalformed      = errors.New("malformed token")
+	ErrAlgorithmNone       = errors.New("unsigned tokens (alg none) are not accepted")
+	ErrAlgorithmHMAC       = errors.New("HMAC signed tokens are not accepted")
+	ErrAlgorithmNotAllowed = errors.New("signing algorithm not allowed for the registration")
+	ErrKeyMismatch         = errors.New("signing algorithm does not match the platform key")
+	ErrSignatureInvalid    = errors.New("token signature is invalid")
+
+	ErrAudienceMismatch  = errors.New("token audience does not contain the registration's client_id")
+	ErrAzpMissing        = errors.New("token with multiple audiences has no authorized party (azp)")
+	ErrAzpMismatch       = errors.New("token authorized party (azp) is not the registration's client_id")
+	ErrExpMissing        = errors.New("token has no expiry (exp)")
+	ErrIatMissing        = errors.New("token has no issued at time (iat)")
+	ErrTokenExpired      = errors.New("token has expired")
+	ErrTokenNotYetValid  = errors.New("token is not valid yet (nbf)")
+	ErrTokenIssuedFuture = errors.New("token was issued in the future (iat)")
+	ErrTokenTooOld       = errors.New("token was issued too long ago (iat)")
+)
+
+// IDTokenValidation configures the claim checks of id_token verification
+type IDTokenValidation struct {
+	// Leeway allows for clock skew between the tool and platform when checking exp, nbf and iat
+	Leeway time.Duration
+	// MaxAge is how long after it was issued (iat) a token is accepted, 0 for no limit
+	MaxAge time.Duration
+}
+
+// DefaultIDTokenValidation is used by VerifyIDToken and MessageLaunchHandlerCreator, handlers that need other
+// settings use MessageLaunchHandlerCreatorWithValidation (or the registration's IDTokenLeeway and IDTokenMaxAge)
+var DefaultIDTokenValidation = IDTokenValidation{Leeway: time.Minute, MaxAge: 10 * time.Minute}
+
+type idTokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// VerifyIDToken verifies a launch id_token with DefaultIDTokenValidation, see IDTokenValidation.Verify
+func VerifyIDToken(registrationDS registrationDatastore.RegistrationDatastore, tokenStr string) (jwt.MapClaims, *registrationDatastore.Registration, error) {
+	return DefaultIDTokenValidation.Verify(registrationDS, tokenStr)
+}
+
+// Verify verifies the signature of a launch id_token with the platform key of its registration (found by issuer and
+// client id, see findLaunchRegistration), and checks its audience and time claims (with the registration's leeway and
+// max age, if it sets them), returning the claims and registration.  The launch handler validates the other claims.
+func (v IDTokenValidation) Verify(registrationDS registrationDatastore.RegistrationDatastore, tokenStr string) (jwt.MapClaims, *registrationDatastore.Registration, error) {
+	parts := strings.Split(tokenStr, ".")
+	if len(parts) != 3 {
+		return nil, nil, errors.Wrap(ErrTokenMalformed, "token must have 3 parts")
+	}
+	var header idTokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, nil, errors.Wrapf(ErrTokenMalformed, "bad header: %v", err)
+	}
+	switch alg := strings.ToUpper(header.Alg); {
+	case alg == "" || alg == "NONE":
+		return nil, nil, ErrAlgorithmNone
+	case strings.HasPrefix(alg, "HS"):
+		return nil, nil, ErrAlgorithmHMAC
+	}
+	claims := jwt.MapClaims{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, nil, errors.Wrapf(ErrTokenMalformed, "bad claims: %v", err)
+	}
+
+	issuer, _ := claims["iss"].(string)
+	if issuer == "" {
+		return nil, nil, errors.New("The issuer cannot be blank")
+	}
+	audiences, err := audienceClaim(claims)
+	if err != nil {
+		return nil, nil, err
+	}
+	azp, _ := claims["azp"].(string)
+	reg, err := findLaunchRegistration(registrationDS, issuer, azp, audiences)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !algorithmAllowed(*reg, header.Alg) {
+		return nil, nil, errors.Wrapf(ErrAlgorithmNotAllowed, "alg %q for issuer %q", header.Alg, issuer)
+	}
+	key, keyAlg, err := lookupPlatformKey(*reg, header.Kid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keyAlg != "" && keyAlg != header.Alg {
+		return nil, nil, errors.Wrapf(ErrKeyMismatch, "token alg %q, key alg %q", header.Alg, keyAlg)
+	}
+	if !keyMatchesAlgorithm(key, header.Alg) {
+		return nil, nil, errors.Wrapf(ErrKeyMismatch, "token alg %q, key type %T", header.Alg, key)
+	}
+	if err := jwt.GetSigningMethod(header.Alg).Verify(parts[0]+"."+parts[1], parts[2], key); err != nil {
+		return nil, nil, errors.Wrap(ErrSignatureInvalid, err.Error())
+	}
+
+	if err := v.forRegistration(*reg).ValidateClaims(claims, reg.ClientID, time.Now()); err != nil {
+		return nil, nil, err
+	}
+	return claims, reg, nil
+}
+
+// forRegistration returns the validation with the registration's overrides applied
+func (v IDTokenValidation) forRegistration(reg registrationDatastore.Registration) IDTokenValidation {
+	if reg.IDTokenLeeway != nil {
+		v.Leeway = time.Duration(*reg.IDTokenLeeway) * time.Second
+	}
+	if reg.IDTokenMaxAge != nil {
+		v.MaxAge = time.Duration(*reg.IDTokenMaxAge) * time.Second
+	}
+	return v
+}
+
+// ValidateClaims checks the token claims as the LTI security framework requires: the audience contains the client id,
+// the authorized party (azp) is the client id (and is present when there are several audiences), and the token is
+// within its validity period (exp, nbf, iat) allowing for Leeway, and not older than MaxAge
+func (v IDTokenValidation) ValidateClaims(claims jwt.MapClaims, clientID string, now time.Time) error {
+	audiences, err := audienceClaim(claims)
+	if err != nil {
+		return err
+	}
+	if !containsString(audiences, clientID) {
+		return errors.Wrapf(ErrAudienceMismatch, "aud %q, client_id %q", audiences, clientID)
+	}
+	azp, _ := claims["azp"].(string)
+	if azp == "" && len(audiences) > 1 {
+		return ErrAzpMissing
+	}
+	if azp != "" && azp != clientID {
+		return errors.Wrapf(ErrAzpMismatch, "azp %q, client_id %q", azp, clientID)
+	}
+
+	exp, err := timeClaim(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if exp == nil {
+		return ErrExpMissing
+	}
+	iat, err := timeClaim(claims, "iat")
+	if err != nil {
+		return err
+	}
+	if iat == nil {
+		return ErrIatMissing
+	}
+	nbf, err := timeClaim(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if !now.Before(exp.Add(v.Leeway)) {
+		return errors.Wrapf(ErrTokenExpired, "expired at %v", exp)
+	}
+	if nbf != nil && now.Add(v.Leeway).Before(*nbf) {
+		return errors.Wrapf(ErrTokenNotYetValid, "not before %v", nbf)
+	}
+	if now.Add(v.Leeway).Before(*iat) {
+		return errors.Wrapf(ErrTokenIssuedFuture, "issued at %v", iat)
+	}
+	if v.MaxAge > 0 && now.Sub(*iat) > v.MaxAge+v.Leeway {
+		return errors.Wrapf(ErrTokenTooOld, "issued at %v", iat)
+	}
+	return nil
+}
+
+// findLaunchRegistration finds the registration a launch is for: the issuer's registration with the authorized party
+// (azp) as its client id, or else the first audience that is one of the issuer's client ids.  Tokens without an
+// audience fall back to the issuer's only registration (and then fail the audience check).
+func findLaunchRegistration(registrationDS registrationDatastore.RegistrationDatastore, issuer, azp string, audiences []string) (*registrationDatastore.Registration, error) {
+	if azp != "" {
+		return registrationDS.FindRegistrationByClientID(issuer, azp)
+	}
+	if len(audiences) == 0 {
+		return registrationDS.FindRegistration(issuer)
+	}
+	var err error
+	for _, aud := range audiences {
+		var reg *registrationDatastore.Registration
+		if reg, err = registrationDS.FindRegistrationByClientID(issuer, aud); err == nil {
+			return reg, nil
+		}
+	}
+	return nil, errors.Wrapf(err, "No registration for issuer %q and audience %q", issuer, audiences)
+}
+
+// audienceClaim returns the aud claim, which may be a string or an array of strings
+func audienceClaim(claims jwt.MapClaims) ([]string, error) {
+	switch aud := claims["aud"].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{aud}, nil
+	case []string:
+		return aud, nil
+	case []interface{}:
+		audiences := make([]string, 0, len(aud))
+		for _, a := range aud {
+			s, ok := a.(string)
+			if !ok {
+				return nil, errors.Wrap(ErrTokenMalformed, "aud claim must be a string or an array of strings")
+			}
+			audiences = append(audiences, s)
+		}
+		return audiences, nil
+	}
+	return nil, errors.Wrap(ErrTokenMalformed, "aud claim must be a string or an array of strings")
+}
+
+// timeClaim returns the NumericDate claim as a time, or nil if it isn't present
+func timeClaim(claims jwt.MapClaims, name string) (*time.Time, error) {
+	var seconds float64
+	switch v := claims[name].(type) {
+	case nil:
+		return nil, nil
+	case float64:
+		seconds = v
+	case int64:
+		seconds = float64(v)
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return nil, errors.Wrapf(ErrTokenMalformed, "%s claim must be a number", name)
+		}
+		seconds = f
+	default:
+		return nil, errors.Wrapf(ErrTokenMalformed, "%s claim must be a number", name)
+	}
+	// beyond this the time can't be held in nanoseconds (around the year 2262)
+	if !(math.Abs(seconds) <= float64(math.MaxInt64/int64(time.Second))) {
+		return nil, errors.Wrapf(ErrTokenMalformed, "%s claim is out of range", name)
+	}
+	t := time.Unix(0, int64(seconds*float64(time.Second)))
+	return &t, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := jwt.DecodeSegment(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// algorithmAllowed returns true if alg is supported and allowed by the registration
+func algorithmAllowed(reg registrationDatastore.Registration, alg string) bool {
+	allowed := reg.AllowedAlgorithms
+	if len(allowed) == 0 {
+		allowed = defaultAlgorithms
+	}
+	return containsString(SupportedAlgorithms, alg) && containsString(allowed, alg)
+}
+
+// keyMatchesAlgorithm checks the key type (the JWK kty) can be used with the algorithm
+func keyMatchesAlgorithm(key interface{}, alg string) bool {
+	switch alg {
+	case "RS256", "RS384", "RS512", "PS256":
+		_, ok := key.(*rsa.PublicKey)
+		return ok
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		return ok && ecKey.Curve == elliptic.P256()
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
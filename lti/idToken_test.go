@@ -0,0 +1,253 @@
+package lti_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GRT/lti-1-3-go-library/lti"
+	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// memoryRegistrationDS is a RegistrationDatastore of a registration, and optionally another for the same issuer
+type memoryRegistrationDS struct {
+	reg   registrationDatastore.Registration
+	other *registrationDatastore.Registration
+}
+
+func (ds *memoryRegistrationDS) FindRegistration(issuer string) (*registrationDatastore.Registration, error) {
+	if issuer != ds.reg.Issuer {
+		return nil, fmt.Errorf("no registration for issuer %q", issuer)
+	}
+	if ds.other != nil {
+		return nil, fmt.Errorf("issuer %q has several registrations", issuer)
+	}
+	reg := ds.reg
+	return &reg, nil
+}
+
+func (ds *memoryRegistrationDS) FindRegistrationByClientID(issuer, clientID string) (*registrationDatastore.Registration, error) {
+	regs, _ := ds.FindAllRegistrations()
+	for _, reg := range regs {
+		if reg.Issuer == issuer && reg.ClientID == clientID {
+			return &reg, nil
+		}
+	}
+	return nil, fmt.Errorf("no registration for issuer %q and client id %q", issuer, clientID)
+}
+
+func (ds *memoryRegistrationDS) FindDeployment(issuer, deploymentID string) (*registrationDatastore.Deployment, error) {
+	return &registrationDatastore.Deployment{DeploymentID: deploymentID}, nil
+}
+
+func (ds *memoryRegistrationDS) FindDeploymentByClientID(issuer, clientID, deploymentID string) (*registrationDatastore.Deployment, error) {
+	return &registrationDatastore.Deployment{DeploymentID: deploymentID}, nil
+}
+
+func (ds *memoryRegistrationDS) FindAllRegistrations() ([]registrationDatastore.Registration, error) {
+	if ds.other != nil {
+		return []registrationDatastore.Registration{ds.reg, *ds.other}, nil
+	}
+	return []registrationDatastore.Registration{ds.reg}, nil
+}
+
+func platformJWK(t *testing.T, pubkey interface{}, kid, alg string) jwk.Key {
+	key, err := jwk.New(pubkey)
+	if err != nil {
+		t.Fatalf("failed to create jwk: %v", err)
+	}
+	key.Set(jwk.KeyIDKey, kid)
+	if alg != "" {
+		key.Set(jwk.AlgorithmKey, alg)
+	}
+	return key
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks, _ := json.Marshal(jwk.Set{Keys: []jwk.Key{
+		platformJWK(t, &rsaKey.PublicKey, "rsa", "RS256"),
+		platformJWK(t, &rsaKey.PublicKey, "rsa-any", ""),
+		platformJWK(t, &ecKey.PublicKey, "ec", "ES256"),
+	}})
+	ds := &memoryRegistrationDS{reg: registrationDatastore.Registration{Issuer: "https://platform.example.com", ClientID: "tool", PlatformJWKS: jwks}}
+	claims := jwt.MapClaims{"iss": "https://platform.example.com", "aud": "tool", "sub": "u1", "iat": time.Now().Unix(), "exp": time.Now().Add(time.Minute).Unix()}
+	sign := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		tokenStr, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("failed to sign with %s: %v", method.Alg(), err)
+		}
+		return tokenStr
+	}
+
+	verified, reg, err := lti.VerifyIDToken(ds, sign(jwt.SigningMethodRS256, "rsa", rsaKey))
+	if err != nil || verified["sub"] != "u1" || reg.ClientID != "tool" {
+		t.Fatalf("expected the RS256 token to verify, got: %v", err)
+	}
+
+	// only RS256 is allowed by default
+	if _, _, err := lti.VerifyIDToken(ds, sign(jwt.SigningMethodES256, "ec", ecKey)); !errors.Is(err, lti.ErrAlgorithmNotAllowed) {
+		t.Fatalf("expected ES256 to not be allowed, got: %v", err)
+	}
+	ds.reg.AllowedAlgorithms = []string{"RS256", "ES256", "PS256"}
+	if _, _, err := lti.VerifyIDToken(ds, sign(jwt.SigningMethodES256, "ec", ecKey)); err != nil {
+		t.Fatalf("expected the allowed ES256 token to verify, got: %v", err)
+	}
+	if _, _, err := lti.VerifyIDToken(ds, sign(jwt.SigningMethodPS256, "rsa-any", rsaKey)); err != nil {
+		t.Fatalf("expected the PS256 token to verify with an RSA key without an alg, got: %v", err)
+	}
+
+	// the token's alg must match the key's alg and type
+	if _, _, err := lti.VerifyIDToken(ds, sign(jwt.SigningMethodPS256, "rsa", rsaKey)); !errors.Is(err, lti.ErrKeyMismatch) {
+		t.Fatalf("expected a PS256 token to not verify with an RS256 key, got: %v", err)
+	}
+	if _, _, err := lti.VerifyIDToken(ds, sign(jwt.SigningMethodES256, "rsa-any", ecKey)); !errors.Is(err, lti.ErrKeyMismatch) {
+		t.Fatalf("expected an ES256 token to not verify with an RSA key, got: %v", err)
+	}
+
+	// unsigned and HMAC tokens (eg: signed with the platform's public key as the secret) are rejected
+	unsigned := sign(jwt.SigningMethodNone, "rsa", jwt.UnsafeAllowNoneSignatureType)
+	if _, _, err := lti.VerifyIDToken(ds, unsigned); !errors.Is(err, lti.ErrAlgorithmNone) {
+		t.Fatalf("expected an alg none token to be rejected, got: %v", err)
+	}
+	ds.reg.AllowedAlgorithms = []string{"RS256", "HS256"}
+	if _, _, err := lti.VerifyIDToken(ds, sign(jwt.SigningMethodHS256, "rsa", []byte("public key"))); !errors.Is(err, lti.ErrAlgorithmHMAC) {
+		t.Fatalf("expected an HMAC token to be rejected, got: %v", err)
+	}
+
+	tokenStr := sign(jwt.SigningMethodRS256, "rsa", rsaKey)
+	parts := strings.Split(tokenStr, ".")
+	tampered, _ := json.Marshal(map[string]interface{}{"iss": "https://platform.example.com", "aud": "tool", "sub": "admin"})
+	parts[1] = jwt.EncodeSegment(tampered)
+	if _, _, err := lti.VerifyIDToken(ds, strings.Join(parts, ".")); !errors.Is(err, lti.ErrSignatureInvalid) {
+		t.Fatalf("expected a tampered token to be rejected, got: %v", err)
+	}
+	if _, _, err := lti.VerifyIDToken(ds, "not.a-token"); !errors.Is(err, lti.ErrTokenMalformed) {
+		t.Fatalf("expected a malformed token to be rejected, got: %v", err)
+	}
+}
+
+func TestVerifyIDTokenClientID(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks, _ := json.Marshal(jwk.Set{Keys: []jwk.Key{platformJWK(t, &rsaKey.PublicKey, "rsa", "RS256")}})
+	ds := &memoryRegistrationDS{
+		reg:   registrationDatastore.Registration{Issuer: "https://platform.example.com", ClientID: "tool-a", PlatformJWKS: jwks},
+		other: &registrationDatastore.Registration{Issuer: "https://platform.example.com", ClientID: "tool-b", PlatformJWKS: jwks},
+	}
+	sign := func(claims jwt.MapClaims) string {
+		claims["iss"], claims["iat"], claims["exp"] = "https://platform.example.com", time.Now().Unix(), time.Now().Add(time.Minute).Unix()
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "rsa"
+		tokenStr, err := token.SignedString(rsaKey)
+		if err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+		return tokenStr
+	}
+
+	// the registration is the one with the aud (or azp) as its client id
+	if _, reg, err := lti.VerifyIDToken(ds, sign(jwt.MapClaims{"aud": "tool-b"})); err != nil || reg.ClientID != "tool-b" {
+		t.Fatalf("expected the tool-b registration, got: %v", err)
+	}
+	if _, reg, err := lti.VerifyIDToken(ds, sign(jwt.MapClaims{"aud": []string{"tool-b", "tool-a"}, "azp": "tool-a"})); err != nil || reg.ClientID != "tool-a" {
+		t.Fatalf("expected the tool-a registration, got: %v", err)
+	}
+	if _, _, err := lti.VerifyIDToken(ds, sign(jwt.MapClaims{"aud": "tool-c"})); err == nil {
+		t.Fatalf("expected a token for an unknown client id to be rejected")
+	}
+}
+
+func TestIDTokenValidationOverrides(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks, _ := json.Marshal(jwk.Set{Keys: []jwk.Key{platformJWK(t, &rsaKey.PublicKey, "rsa", "RS256")}})
+	ds := &memoryRegistrationDS{reg: registrationDatastore.Registration{Issuer: "https://platform.example.com", ClientID: "tool", PlatformJWKS: jwks}}
+	issued := time.Now().Add(-15 * time.Minute)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"iss": "https://platform.example.com", "aud": "tool", "iat": issued.Unix(), "exp": time.Now().Add(time.Minute).Unix()})
+	token.Header["kid"] = "rsa"
+	tokenStr, _ := token.SignedString(rsaKey)
+
+	if _, _, err := lti.VerifyIDToken(ds, tokenStr); !errors.Is(err, lti.ErrTokenTooOld) {
+		t.Fatalf("expected the default max age to reject the token, got: %v", err)
+	}
+	// a handler's own settings
+	if _, _, err := (lti.IDTokenValidation{MaxAge: time.Hour}).Verify(ds, tokenStr); err != nil {
+		t.Fatalf("expected the longer max age to accept the token, got: %v", err)
+	}
+	// the registration's override
+	maxAge := 3600
+	ds.reg.IDTokenMaxAge = &maxAge
+	if _, _, err := lti.VerifyIDToken(ds, tokenStr); err != nil {
+		t.Fatalf("expected the registration's max age to accept the token, got: %v", err)
+	}
+
+	// an explicit zero leeway is strict, rather than the default
+	expired := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"iss": "https://platform.example.com", "aud": "tool", "iat": time.Now().Add(-time.Minute).Unix(), "exp": time.Now().Add(-10 * time.Second).Unix()})
+	expired.Header["kid"] = "rsa"
+	expiredStr, _ := expired.SignedString(rsaKey)
+	if _, _, err := lti.VerifyIDToken(ds, expiredStr); err != nil {
+		t.Fatalf("expected the default leeway to accept the token, got: %v", err)
+	}
+	leeway := 0
+	ds.reg.IDTokenLeeway = &leeway
+	if _, _, err := lti.VerifyIDToken(ds, expiredStr); !errors.Is(err, lti.ErrTokenExpired) {
+		t.Fatalf("expected the registration's zero leeway to reject the token, got: %v", err)
+	}
+	if lti.DefaultIDTokenValidation.MaxAge != 10*time.Minute {
+		t.Fatalf("the default validation should not change, got: %+v", lti.DefaultIDTokenValidation)
+	}
+}
+
+func TestValidateIDTokenClaims(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	validation := lti.IDTokenValidation{Leeway: 30 * time.Second, MaxAge: 5 * time.Minute}
+	claimsFrom := func(js string) jwt.MapClaims {
+		claims := jwt.MapClaims{}
+		if err := json.Unmarshal([]byte(js), &claims); err != nil {
+			t.Fatalf("bad test claims: %v", err)
+		}
+		return claims
+	}
+	times := func(iat, exp int64) string {
+		return fmt.Sprintf(`"iat": %d, "exp": %d`, now.Unix()+iat, now.Unix()+exp)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		claims string
+		want   error
+	}{
+		{"single audience", `{"aud": "tool", ` + times(-10, 60) + `}`, nil},
+		{"multiple audiences", `{"aud": ["other", "tool"], "azp": "tool", ` + times(-10, 60) + `}`, nil},
+		{"within leeway", `{"aud": "tool", "nbf": 1700000020, ` + times(20, -20) + `}`, nil},
+		{"wrong audience", `{"aud": ["other"], ` + times(-10, 60) + `}`, lti.ErrAudienceMismatch},
+		{"multiple audiences without azp", `{"aud": ["other", "tool"], ` + times(-10, 60) + `}`, lti.ErrAzpMissing},
+		{"wrong azp", `{"aud": "tool", "azp": "other", ` + times(-10, 60) + `}`, lti.ErrAzpMismatch},
+		{"no exp", `{"aud": "tool", "iat": 1700000000}`, lti.ErrExpMissing},
+		{"no iat", `{"aud": "tool", "exp": 1700000060}`, lti.ErrIatMissing},
+		{"expired", `{"aud": "tool", ` + times(-120, -31) + `}`, lti.ErrTokenExpired},
+		{"not yet valid", `{"aud": "tool", "nbf": 1700000060, ` + times(-10, 120) + `}`, lti.ErrTokenNotYetValid},
+		{"issued in the future", `{"aud": "tool", ` + times(60, 120) + `}`, lti.ErrTokenIssuedFuture},
+		{"too old", `{"aud": "tool", ` + times(-400, 3600) + `}`, lti.ErrTokenTooOld},
+		{"bad exp", `{"aud": "tool", "iat": 1700000000, "exp": "tomorrow"}`, lti.ErrTokenMalformed},
+		{"exp out of range", `{"aud": "tool", "iat": 1700000000, "exp": 1e300}`, lti.ErrTokenMalformed},
+		{"iat out of range", `{"aud": "tool", "iat": -1e19, "exp": 1700000060}`, lti.ErrTokenMalformed},
+	} {
+		err := validation.ValidateClaims(claimsFrom(tc.claims), "tool", now)
+		if (tc.want == nil && err != nil) || (tc.want != nil && !errors.Is(err, tc.want)) {
+			t.Errorf("%s: expected %v, got: %v", tc.name, tc.want, err)
+		}
+	}
+}
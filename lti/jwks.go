@@ -0,0 +1,78 @@
+package lti
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/pkg/errors"
+)
+
+// JWKSHandler creates an http handler that publishes the public keys of every registration's tool keys
+// as a JWK Set.  Platforms use it to verify the jwts the tool signs (service client assertions, deep link responses).
+func JWKSHandler(registrationDS registrationDatastore.RegistrationDatastore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		regs, err := registrationDS.FindAllRegistrations()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		now := time.Now()
+		keyset := jwk.Set{Keys: make([]jwk.Key, 0)}
+		seen := make(map[string]bool)
+		for _, reg := range regs {
+			// active, next and (not yet expired) retired keys are all published
+			for _, toolKey := range reg.PublishedKeys(now) {
+				key, err := toolPublicJWK(toolKey)
+				if err != nil {
+					log.Printf("JWKSHandler: skipping key for clientId %q: %v", reg.ClientID, err)
+					continue
+				}
+				// the same key may be shared by several registrations
+				if seen[key.KeyID()] {
+					continue
+				}
+				seen[key.KeyID()] = true
+				keyset.Keys = append(keyset.Keys, key)
+			}
+		}
+		b, err := json.Marshal(keyset)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
+
+// toolPublicJWK derives the public JWK (with kid, alg and use set) from a tool key
+func toolPublicJWK(toolKey registrationDatastore.ToolKey) (jwk.Key, error) {
+	privkey, err := toolKey.RSAPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	kid, err := toolKey.ID()
+	if err != nil {
+		return nil, err
+	}
+	key, err := jwk.New(&privkey.PublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create jwk from tool public key")
+	}
+	if err := key.Set(jwk.KeyIDKey, kid); err != nil {
+		return nil, errors.Wrap(err, "Failed to set the jwk kid")
+	}
+	if err := key.Set(jwk.AlgorithmKey, jwt.SigningMethodRS256.Alg()); err != nil {
+		return nil, errors.Wrap(err, "Failed to set the jwk alg")
+	}
+	if err := key.Set(jwk.KeyUsageKey, string(jwk.ForSignature)); err != nil {
+		return nil, errors.Wrap(err, "Failed to set the jwk use")
+	}
+	return key, nil
+}
@@ -0,0 +1,51 @@
+package lti_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GRT/lti-1-3-go-library/lti"
+	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+func TestJWKSHandler(t *testing.T) {
+	ds, err := registrationDatastore.NewJsonRegistrationDatastore(regJSONPath)
+	if err != nil {
+		t.Fatalf("failed to create the json reg datastore: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	lti.JWKSHandler(ds).ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/jwks", nil))
+	if rec.Code != 200 {
+		t.Fatalf("unexpected status from jwks handler: %d", rec.Code)
+	}
+	keyset, err := jwk.ParseString(rec.Body.String())
+	if err != nil {
+		t.Fatalf("jwks handler returned an invalid JWK Set: %v", err)
+	}
+	regs, _ := ds.FindAllRegistrations()
+	if len(keyset.Keys) != len(regs) {
+		t.Fatalf("expected %d keys, got %d", len(regs), len(keyset.Keys))
+	}
+
+	// tokens signed by the tool must carry a kid that is published in the keyset
+	reg := getTestRegistration(t)
+	dl := lti.NewDeepLinkResponse(*reg, "dep1", lti.DeepLinkingSettings{AcceptTypes: []string{"ltiResourceLink"}})
+	tokenStr, err := dl.GetResponseJWT(nil)
+	if err != nil {
+		t.Fatalf("failed to create deep link response jwt: %v", err)
+	}
+	token, err := jwt.Parse(tokenStr, func(tok *jwt.Token) (interface{}, error) {
+		kid, _ := tok.Header["kid"].(string)
+		keys := keyset.LookupKeyID(kid)
+		if len(keys) != 1 {
+			t.Fatalf("kid %q was not found in the published keyset", kid)
+		}
+		return keys[0].Materialize()
+	})
+	if err != nil || !token.Valid {
+		t.Fatalf("token could not be verified with the published key: %v", err)
+	}
+}
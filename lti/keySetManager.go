@@ -0,0 +1,279 @@
+package lti
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/pkg/errors"
+)
+
+// KeySetPolicy is how a KeySetManager caches and refreshes platform keysets
+type KeySetPolicy struct {
+	// DefaultTTL is how long keysets are cached when the platform sends no cache headers
+	DefaultTTL time.Duration
+	// MinTTL and MaxTTL bound the lifetime the platform's cache headers ask for
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// RefreshBefore is how long before expiry a keyset is refreshed in the background (at most half its lifetime)
+	RefreshBefore time.Duration
+	// MinRefetchInterval rate limits fetches of a keyset, both refetches for unknown kids and retries after a failed fetch
+	MinRefetchInterval time.Duration
+	// MaxStale is how long after it expired a keyset is still used while the platform's keyset endpoint is failing,
+	// 0 for no limit
+	MaxStale time.Duration
+}
+
+// DefaultKeySetPolicy caches keysets for 15 minutes, unless the platform says otherwise
+var DefaultKeySetPolicy = KeySetPolicy{
+	DefaultTTL:         15 * time.Minute,
+	MinTTL:             time.Minute,
+	MaxTTL:             24 * time.Hour,
+	RefreshBefore:      time.Minute,
+	MinRefetchInterval: 30 * time.Second,
+	MaxStale:           time.Hour,
+}
+
+// DefaultKeySetManager is the KeySetManager launches are validated with
+var DefaultKeySetManager = NewKeySetManager(nil, DefaultKeySetPolicy)
+
+// KeySetManager fetches and caches platform JWK Sets by url.  Keysets are refetched when a token has a kid that isn't
+// in the cached set (eg: after the platform rotated its keys), and refreshed in the background before they expire.
+// When the platform's keyset endpoint is briefly unavailable the last keyset fetched is used (for up to MaxStale after
+// it expired).  It is safe for concurrent use.
+type KeySetManager struct {
+	client *http.Client
+	policy KeySetPolicy
+	mu     sync.Mutex
+	sets   map[string]*cachedKeySet
+}
+
+type cachedKeySet struct {
+	// fetchMu is held while fetching, so each url is only fetched once at a time
+	fetchMu   sync.Mutex
+	mu        sync.Mutex
+	keyset    *jwk.Set
+	expiresAt time.Time
+	// goodUntil is when the last keyset fetched expired, expiresAt is extended while fetches fail
+	goodUntil   time.Time
+	refreshAt   time.Time
+	lastFetch   time.Time
+	refreshing  bool
+	lastFailure error
+}
+
+// NewKeySetManager creates a KeySetManager that fetches keysets with client (a default client if nil)
+func NewKeySetManager(client *http.Client, policy KeySetPolicy) *KeySetManager {
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &KeySetManager{client: client, policy: policy, sets: make(map[string]*cachedKeySet)}
+}
+
+// LookupKey returns the key with the kid from the keyset at url, fetching the keyset if it isn't cached, has
+// expired, or doesn't have the kid (at most once per MinRefetchInterval)
+func (m *KeySetManager) LookupKey(url, kid string) (jwk.Key, error) {
+	entry := m.entry(url)
+	keyset, err := m.current(url, entry)
+	if err != nil {
+		return nil, err
+	}
+	if key := lookupKeyID(keyset, kid); key != nil {
+		return key, nil
+	}
+	// the platform may have rotated its keys since the keyset was fetched
+	if m.canRefetch(entry) {
+		log.Printf("kid %q not in the cached keyset from %q, refetching", kid, url)
+		if keyset, err = m.fetch(url, entry); err == nil {
+			if key := lookupKeyID(keyset, kid); key != nil {
+				return key, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Token validation key not found for kid: %q", kid)
+}
+
+// Invalidate drops the cached keyset for the url, so the next lookup fetches it
+func (m *KeySetManager) Invalidate(url string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sets, url)
+}
+
+func (m *KeySetManager) entry(url string) *cachedKeySet {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, exists := m.sets[url]
+	if !exists {
+		entry = &cachedKeySet{}
+		m.sets[url] = entry
+	}
+	return entry
+}
+
+// current returns the cached keyset, fetching it if there is none or it has expired, and starting a background
+// refresh when it is about to expire.  Fetches are rate limited by MinRefetchInterval, until then an expired keyset
+// is still used, or the last fetch's error returned if there is no keyset.
+func (m *KeySetManager) current(url string, entry *cachedKeySet) (*jwk.Set, error) {
+	now := time.Now()
+	entry.mu.Lock()
+	keyset := entry.keyset
+	canRefetch := now.Sub(entry.lastFetch) >= m.policy.MinRefetchInterval
+	if keyset != nil && (now.Before(entry.expiresAt) || !canRefetch) {
+		if !entry.refreshing && canRefetch && !now.Before(entry.refreshAt) {
+			entry.refreshing = true
+			go func() {
+				m.fetch(url, entry)
+				entry.mu.Lock()
+				entry.refreshing = false
+				entry.mu.Unlock()
+			}()
+		}
+		entry.mu.Unlock()
+		return keyset, nil
+	}
+	if keyset == nil && !canRefetch && entry.lastFailure != nil {
+		// the platform failed to send a keyset, don't refetch it for every launch until MinRefetchInterval
+		err := entry.lastFailure
+		entry.mu.Unlock()
+		return nil, err
+	}
+	entry.mu.Unlock()
+	return m.fetch(url, entry)
+}
+
+func (m *KeySetManager) canRefetch(entry *cachedKeySet) bool {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	return time.Since(entry.lastFetch) >= m.policy.MinRefetchInterval
+}
+
+// fetch gets the keyset from the platform and caches it.  If the fetch fails the last good keyset is returned
+// (and retried after MinRefetchInterval), unless it expired more than MaxStale ago.  Callers that wait on another caller's fetch share its result.
+func (m *KeySetManager) fetch(url string, entry *cachedKeySet) (*jwk.Set, error) {
+	started := time.Now()
+	entry.fetchMu.Lock()
+	defer entry.fetchMu.Unlock()
+
+	entry.mu.Lock()
+	if entry.lastFetch.After(started) {
+		// fetched while this caller waited for the lock
+		keyset, err := entry.keyset, entry.lastFailure
+		entry.mu.Unlock()
+		if keyset != nil {
+			return keyset, nil
+		}
+		return nil, err
+	}
+	entry.mu.Unlock()
+
+	log.Printf("Fetching keyset from: %q", url)
+	keyset, ttl, err := m.download(url)
+	now := time.Now()
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	entry.lastFetch = now
+	if err != nil {
+		entry.lastFailure = err
+		if entry.keyset != nil && m.policy.MaxStale > 0 && now.Sub(entry.goodUntil) > m.policy.MaxStale {
+			log.Printf("Dropping the keyset fetched from %q, it expired at %v: %v", url, entry.goodUntil, err)
+			entry.keyset = nil
+		}
+		if entry.keyset == nil {
+			return nil, err
+		}
+		log.Printf("Using the last keyset fetched from %q: %v", url, err)
+		entry.expiresAt = now.Add(m.policy.MinRefetchInterval)
+		entry.refreshAt = entry.expiresAt
+		return entry.keyset, nil
+	}
+	entry.keyset, entry.expiresAt, entry.lastFailure = keyset, now.Add(ttl), nil
+	entry.goodUntil = entry.expiresAt
+	entry.refreshAt = entry.expiresAt.Add(-m.refreshWindow(ttl))
+	return keyset, nil
+}
+
+// refreshWindow is how long before a keyset with the ttl expires it is refreshed: RefreshBefore, but no more than half
+// the ttl, so short lived keysets aren't refreshed as soon as they are fetched
+func (m *KeySetManager) refreshWindow(ttl time.Duration) time.Duration {
+	if m.policy.RefreshBefore > ttl/2 {
+		return ttl / 2
+	}
+	return m.policy.RefreshBefore
+}
+
+// download fetches and parses the keyset, returning it with the lifetime from the response's cache headers
+func (m *KeySetManager) download(url string) (*jwk.Set, time.Duration, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "Failed creating keyset request for: %q", url)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "Failed fetching keyset from endpoint: %q", url)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "Failed reading keyset from endpoint: %q", url)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("Failed fetching keyset from endpoint: %q (%s)", url, resp.Status)
+	}
+	keyset, err := jwk.ParseBytes(body)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "Failed parsing keyset from endpoint: %q", url)
+	}
+	return keyset, m.ttl(resp.Header, time.Now()), nil
+}
+
+// ttl is how long to cache a keyset for, from the Cache-Control max-age or Expires headers
+func (m *KeySetManager) ttl(header http.Header, now time.Time) time.Duration {
+	ttl := m.policy.DefaultTTL
+	if maxAge, ok := cacheControlMaxAge(header.Get("Cache-Control")); ok {
+		ttl = maxAge
+	} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		ttl = expires.Sub(now)
+	}
+	if ttl < m.policy.MinTTL {
+		ttl = m.policy.MinTTL
+	}
+	if m.policy.MaxTTL > 0 && ttl > m.policy.MaxTTL {
+		ttl = m.policy.MaxTTL
+	}
+	return ttl
+}
+
+// cacheControlMaxAge returns the max-age of a Cache-Control header, treating no-cache and no-store as 0
+func cacheControlMaxAge(cacheControl string) (time.Duration, bool) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			return 0, true
+		case strings.HasPrefix(directive, "max-age="):
+			if seconds, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(directive, "max-age="), `"`)); err == nil {
+				return time.Duration(seconds) * time.Second, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func lookupKeyID(keyset *jwk.Set, kid string) jwk.Key {
+	keys := keyset.LookupKeyID(kid)
+	if len(keys) == 0 {
+		return nil
+	}
+	if len(keys) > 1 {
+		log.Printf("Multiple validation keys found for kid value: %q (using first one)", kid)
+	}
+	return keys[0]
+}
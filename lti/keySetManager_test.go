@@ -0,0 +1,199 @@
+package lti_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GRT/lti-1-3-go-library/lti"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// testKeySetServer serves a JWK Set of the given kids, counting fetches
+type testKeySetServer struct {
+	mu      sync.Mutex
+	kids    []string
+	down    bool
+	fetches int
+	header  http.Header
+}
+
+func (s *testKeySetServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetches++
+	if s.down {
+		http.Error(w, "unavailable", 503)
+		return
+	}
+	privkey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	keyset := jwk.Set{}
+	for _, kid := range s.kids {
+		key, _ := jwk.New(&privkey.PublicKey)
+		key.Set(jwk.KeyIDKey, kid)
+		keyset.Keys = append(keyset.Keys, key)
+	}
+	for k, v := range s.header {
+		w.Header()[k] = v
+	}
+	json.NewEncoder(w).Encode(keyset)
+}
+
+func (s *testKeySetServer) set(fn func(s *testKeySetServer)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s)
+}
+
+func (s *testKeySetServer) fetchCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+func TestKeySetManager(t *testing.T) {
+	keys := &testKeySetServer{kids: []string{"k1"}}
+	platform := httptest.NewServer(keys)
+	defer platform.Close()
+	url := platform.URL + "/jwks"
+	manager := lti.NewKeySetManager(nil, lti.KeySetPolicy{DefaultTTL: time.Hour, MaxTTL: time.Hour, MinRefetchInterval: 50 * time.Millisecond})
+
+	if key, err := manager.LookupKey(url, "k1"); err != nil || key.KeyID() != "k1" {
+		t.Fatalf("expected key k1, got: %v, %v", key, err)
+	}
+	if _, err := manager.LookupKey(url, "k1"); err != nil || keys.fetchCount() != 1 {
+		t.Fatalf("expected the cached keyset to be used, fetches: %d, err: %v", keys.fetchCount(), err)
+	}
+
+	// a rotated key is found by refetching, but only once per MinRefetchInterval
+	keys.set(func(s *testKeySetServer) { s.kids = []string{"k2"} })
+	if _, err := manager.LookupKey(url, "k2"); err == nil || keys.fetchCount() != 1 {
+		t.Fatalf("expected the refetch to be rate limited, fetches: %d, err: %v", keys.fetchCount(), err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if key, err := manager.LookupKey(url, "k2"); err != nil || key.KeyID() != "k2" || keys.fetchCount() != 2 {
+		t.Fatalf("expected the unknown kid to refetch the keyset, fetches: %d, err: %v", keys.fetchCount(), err)
+	}
+
+	// the last good keyset is used while the platform is down
+	keys.set(func(s *testKeySetServer) { s.down = true })
+	time.Sleep(60 * time.Millisecond)
+	manager.LookupKey(url, "k3")
+	if key, err := manager.LookupKey(url, "k2"); err != nil || key.KeyID() != "k2" {
+		t.Fatalf("expected the last good keyset to be used, got: %v", err)
+	}
+}
+
+func TestKeySetManagerCacheHeaders(t *testing.T) {
+	keys := &testKeySetServer{kids: []string{"k1"}, header: http.Header{"Cache-Control": []string{"public, max-age=0"}}}
+	platform := httptest.NewServer(keys)
+	defer platform.Close()
+	url := platform.URL + "/jwks"
+	manager := lti.NewKeySetManager(nil, lti.KeySetPolicy{DefaultTTL: time.Hour, MinTTL: 50 * time.Millisecond, RefreshBefore: 10 * time.Millisecond})
+
+	manager.LookupKey(url, "k1")
+	time.Sleep(60 * time.Millisecond)
+	if _, err := manager.LookupKey(url, "k1"); err != nil || keys.fetchCount() != 2 {
+		t.Fatalf("expected the keyset to expire per the cache headers, fetches: %d, err: %v", keys.fetchCount(), err)
+	}
+
+	// keysets about to expire are refreshed in the background, while the cached one is used
+	time.Sleep(45 * time.Millisecond)
+	if _, err := manager.LookupKey(url, "k1"); err != nil {
+		t.Fatalf("expected the cached keyset, got: %v", err)
+	}
+	for i := 0; i < 50 && keys.fetchCount() < 3; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if keys.fetchCount() != 3 {
+		t.Fatalf("expected a background refresh, fetches: %d", keys.fetchCount())
+	}
+}
+
+func TestKeySetManagerRateLimit(t *testing.T) {
+	// keysets the platform says not to cache are refreshed at most once per MinRefetchInterval
+	keys := &testKeySetServer{kids: []string{"k1"}, header: http.Header{"Cache-Control": []string{"no-cache"}}}
+	platform := httptest.NewServer(keys)
+	defer platform.Close()
+	url := platform.URL + "/jwks"
+	manager := lti.NewKeySetManager(nil, lti.KeySetPolicy{DefaultTTL: time.Hour, MinTTL: 2 * time.Second, RefreshBefore: 2 * time.Second, MinRefetchInterval: time.Second})
+	for i := 0; i < 20; i++ {
+		if _, err := manager.LookupKey(url, "k1"); err != nil {
+			t.Fatalf("expected key k1, got: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if keys.fetchCount() != 1 {
+		t.Fatalf("expected the no-cache keyset to be fetched once, fetches: %d", keys.fetchCount())
+	}
+
+	// while the platform is down, the last good keyset is used and the platform is retried once per MinRefetchInterval
+	keys = &testKeySetServer{kids: []string{"k1"}}
+	outage := httptest.NewServer(keys)
+	defer outage.Close()
+	url = outage.URL + "/jwks"
+	manager = lti.NewKeySetManager(nil, lti.KeySetPolicy{DefaultTTL: 50 * time.Millisecond, RefreshBefore: time.Minute, MinRefetchInterval: 40 * time.Millisecond})
+	manager.LookupKey(url, "k1")
+	keys.set(func(s *testKeySetServer) { s.down = true })
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 50; i++ {
+		if _, err := manager.LookupKey(url, "k1"); err != nil {
+			t.Fatalf("expected the last good keyset to be used, got: %v", err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if keys.fetchCount() != 2 {
+		t.Fatalf("expected one fetch during the outage, fetches: %d", keys.fetchCount()-1)
+	}
+}
+
+func TestKeySetManagerInitialOutage(t *testing.T) {
+	// a platform that is down on the first lookup is retried once per MinRefetchInterval, not on every lookup
+	keys := &testKeySetServer{kids: []string{"k1"}, down: true}
+	platform := httptest.NewServer(keys)
+	defer platform.Close()
+	url := platform.URL + "/jwks"
+	manager := lti.NewKeySetManager(nil, lti.KeySetPolicy{DefaultTTL: time.Hour, MinRefetchInterval: 50 * time.Millisecond})
+	for i := 0; i < 20; i++ {
+		if _, err := manager.LookupKey(url, "k1"); err == nil {
+			t.Fatal("expected an error while the platform is down")
+		}
+	}
+	if keys.fetchCount() != 1 {
+		t.Fatalf("expected one fetch during the outage, fetches: %d", keys.fetchCount())
+	}
+
+	keys.set(func(s *testKeySetServer) { s.down = false })
+	time.Sleep(60 * time.Millisecond)
+	if key, err := manager.LookupKey(url, "k1"); err != nil || key.KeyID() != "k1" || keys.fetchCount() != 2 {
+		t.Fatalf("expected the keyset to be fetched once the platform is back, fetches: %d, err: %v", keys.fetchCount(), err)
+	}
+}
+
+func TestKeySetManagerMaxStale(t *testing.T) {
+	// the last good keyset is only used for MaxStale after it expired while the platform is down
+	keys := &testKeySetServer{kids: []string{"k1"}}
+	platform := httptest.NewServer(keys)
+	defer platform.Close()
+	url := platform.URL + "/jwks"
+	manager := lti.NewKeySetManager(nil, lti.KeySetPolicy{DefaultTTL: 50 * time.Millisecond, MinRefetchInterval: 20 * time.Millisecond, MaxStale: 100 * time.Millisecond})
+	if _, err := manager.LookupKey(url, "k1"); err != nil {
+		t.Fatalf("expected key k1, got: %v", err)
+	}
+
+	keys.set(func(s *testKeySetServer) { s.down = true })
+	time.Sleep(70 * time.Millisecond)
+	if _, err := manager.LookupKey(url, "k1"); err != nil {
+		t.Fatalf("expected the recently expired keyset to be used, got: %v", err)
+	}
+	time.Sleep(120 * time.Millisecond)
+	if _, err := manager.LookupKey(url, "k1"); err == nil {
+		t.Fatalf("expected the keyset to stop being used after MaxStale")
+	}
+}
@@ -0,0 +1,194 @@
+package lti
+
+import (
+	"encoding/json"
+	"fmt"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+)
+
+// claim names, as found in the id_token of a message launch
+const (
+	claimMessageType  = "https://purl.imsglobal.org/spec/lti/claim/message_type"
+	claimVersion      = "https://purl.imsglobal.org/spec/lti/claim/version"
+	claimDeploymentID = "https://purl.imsglobal.org/spec/lti/claim/deployment_id"
+
+	messageTypeResourceLink = "LtiResourceLinkRequest"
+	messageTypeDeepLinking  = "LtiDeepLinkingRequest"
+)
+
+// LaunchClaims is the typed form of the claims sent by the platform in a message launch id_token
+type LaunchClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        Audience `json:"aud"`
+	AuthorizedParty string   `json:"azp,omitempty"`
+	ExpiresAt       int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+
+	Name       string `json:"name,omitempty"`
+	GivenName  string `json:"given_name,omitempty"`
+	FamilyName string `json:"family_name,omitempty"`
+	MiddleName string `json:"middle_name,omitempty"`
+	Email      string `json:"email,omitempty"`
+	Picture    string `json:"picture,omitempty"`
+	Locale     string `json:"locale,omitempty"`
+
+	MessageType       string   `json:"https://purl.imsglobal.org/spec/lti/claim/message_type"`
+	Version           string   `json:"https://purl.imsglobal.org/spec/lti/claim/version"`
+	DeploymentID      string   `json:"https://purl.imsglobal.org/spec/lti/claim/deployment_id"`
+	TargetLinkURI     string   `json:"https://purl.imsglobal.org/spec/lti/claim/target_link_uri,omitempty"`
+	Roles             Roles    `json:"https://purl.imsglobal.org/spec/lti/claim/roles"`
+	RoleScopeMentor   []string `json:"https://purl.imsglobal.org/spec/lti/claim/role_scope_mentor,omitempty"`
+	Lti11LegacyUserID string   `json:"https://purl.imsglobal.org/spec/lti/claim/lti11_legacy_user_id,omitempty"`
+
+	Context             *ContextClaim            `json:"https://purl.imsglobal.org/spec/lti/claim/context,omitempty"`
+	ResourceLink        *ResourceLinkClaim       `json:"https://purl.imsglobal.org/spec/lti/claim/resource_link,omitempty"`
+	ToolPlatform        *ToolPlatformClaim       `json:"https://purl.imsglobal.org/spec/lti/claim/tool_platform,omitempty"`
+	LaunchPresentation  *LaunchPresentationClaim `json:"https://purl.imsglobal.org/spec/lti/claim/launch_presentation,omitempty"`
+	Custom              CustomClaim              `json:"https://purl.imsglobal.org/spec/lti/claim/custom,omitempty"`
+	Lis                 *LisClaim                `json:"https://purl.imsglobal.org/spec/lti/claim/lis,omitempty"`
+	AGS                 *AgsEndpointClaim        `json:"https://purl.imsglobal.org/spec/lti-ags/claim/endpoint,omitempty"`
+	NRPS                *NrpsServiceClaim        `json:"https://purl.imsglobal.org/spec/lti-nrps/claim/namesroleservice,omitempty"`
+	DeepLinkingSettings *DeepLinkingSettings     `json:"https://purl.imsglobal.org/spec/lti-dl/claim/deep_linking_settings,omitempty"`
+}
+
+// ContextClaim describes the context (course, section, group...) the launch came from
+type ContextClaim struct {
+	ID    string   `json:"id"`
+	Label string   `json:"label,omitempty"`
+	Title string   `json:"title,omitempty"`
+	Type  []string `json:"type,omitempty"`
+}
+
+// ResourceLinkClaim describes the resource link that was launched
+type ResourceLinkClaim struct {
+	ID          string `json:"id"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// ToolPlatformClaim describes the platform instance that sent the launch
+type ToolPlatformClaim struct {
+	GUID              string `json:"guid,omitempty"`
+	Name              string `json:"name,omitempty"`
+	ContactEmail      string `json:"contact_email,omitempty"`
+	Description       string `json:"description,omitempty"`
+	URL               string `json:"url,omitempty"`
+	ProductFamilyCode string `json:"product_family_code,omitempty"`
+	Version           string `json:"version,omitempty"`
+}
+
+// LaunchPresentationClaim describes how the platform is presenting the tool
+type LaunchPresentationClaim struct {
+	DocumentTarget string `json:"document_target,omitempty"`
+	Height         int    `json:"height,omitempty"`
+	Width          int    `json:"width,omitempty"`
+	ReturnURL      string `json:"return_url,omitempty"`
+	Locale         string `json:"locale,omitempty"`
+}
+
+// LisClaim holds the LIS identifiers for the user and context
+type LisClaim struct {
+	PersonSourcedID         string `json:"person_sourcedid,omitempty"`
+	CourseOfferingSourcedID string `json:"course_offering_sourcedid,omitempty"`
+	CourseSectionSourcedID  string `json:"course_section_sourcedid,omitempty"`
+	OutcomeServiceURL       string `json:"outcome_service_url,omitempty"`
+	ResultSourcedID         string `json:"result_sourcedid,omitempty"`
+}
+
+// AgsEndpointClaim holds the assignment and grade service endpoint claim
+type AgsEndpointClaim struct {
+	Scope     []string `json:"scope"`
+	LineItems string   `json:"lineitems,omitempty"`
+	LineItem  string   `json:"lineitem,omitempty"`
+}
+
+// NrpsServiceClaim holds the names and role provisioning service claim
+type NrpsServiceClaim struct {
+	ContextMembershipsURL string   `json:"context_memberships_url"`
+	ServiceVersions       []string `json:"service_versions,omitempty"`
+}
+
+// CustomClaim holds the custom parameters of the launch.  Non-string values sent by
+// the platform are converted to their json representation.
+type CustomClaim map[string]string
+
+// UnmarshalJSON accepts custom values of any json type
+func (c *CustomClaim) UnmarshalJSON(data []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	m := make(CustomClaim, len(raw))
+	for k, v := range raw {
+		if s, ok := v.(string); ok {
+			m[k] = s
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		m[k] = string(b)
+	}
+	*c = m
+	return nil
+}
+
+// Audience holds the aud claim, which may be sent as a single string or as an array
+type Audience []string
+
+// UnmarshalJSON accepts either a string or an array of strings
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var multi []string
+	if err := json.Unmarshal(data, &multi); err != nil {
+		return fmt.Errorf("aud claim must be a string or an array of strings")
+	}
+	*a = Audience(multi)
+	return nil
+}
+
+// Contains returns true if the given client id is one of the audiences
+func (a Audience) Contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// NewLaunchClaims converts the raw jwt claims of a launch into LaunchClaims
+func NewLaunchClaims(claims jwt.MapClaims) (*LaunchClaims, error) {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to serialize launch claims")
+	}
+	return parseLaunchClaims(b)
+}
+
+// IsResourceLinkLaunch returns true if the launch is an LtiResourceLinkRequest
+func (c *LaunchClaims) IsResourceLinkLaunch() bool {
+	return c.MessageType == messageTypeResourceLink
+}
+
+// IsDeepLinkLaunch returns true if the launch is an LtiDeepLinkingRequest
+func (c *LaunchClaims) IsDeepLinkLaunch() bool {
+	return c.MessageType == messageTypeDeepLinking
+}
+
+func parseLaunchClaims(b []byte) (*LaunchClaims, error) {
+	var lc LaunchClaims
+	if err := json.Unmarshal(b, &lc); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse launch claims")
+	}
+	return &lc, nil
+}
@@ -1,7 +1,6 @@
 package lti
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,20 +11,14 @@ import (
 
 	"github.com/pkg/errors"
 
-	jwt "github.com/dgrijalva/jwt-go"
-
 	"github.com/gorilla/sessions"
 )
 
-const (
-	userKeyName = "user"
-)
-
 // MessageLaunch a struct that represents an LTI 1.3 Tool Launch
 type MessageLaunch struct {
 	ltiBase
 	Debug        bool
-	cachedClaims *jwt.MapClaims
+	claims       *LaunchClaims
 	registration *registrationDatastore.Registration
 	launchID     string
 }
@@ -33,8 +26,14 @@ type MessageLaunch struct {
 // used to store key/values in the context
 type ltiContextKey int
 
-// key for launchID values
-const launchIDKey ltiContextKey = 0
+const (
+	// key for launchID values
+	launchIDKey ltiContextKey = 0
+	// key for typed launch claims
+	launchClaimsKey ltiContextKey = 1
+	// key for the verified id_token claims
+	idTokenClaimsKey ltiContextKey = 2
+)
 
 // NewMessageLaunch creates a MessageLaunch with params.
 func NewMessageLaunch(registrationDS registrationDatastore.RegistrationDatastore, cache ltiCache.Cache, store sessions.Store, sessionName string, debug bool) *MessageLaunch {
@@ -50,24 +49,30 @@ func NewMessageLaunchFromCache(launchID string, r *http.Request, registrationDS
 	if claimsStr == "" {
 		return nil, fmt.Errorf("Could not find message launch from cache with launchId: %q", launchID)
 	}
-	var claims jwt.MapClaims
-	if err := json.Unmarshal([]byte(claimsStr), &claims); err != nil {
+	claims, err := parseLaunchClaims([]byte(claimsStr))
+	if err != nil {
 		return nil, errors.Wrap(err, "Failed to unmarshall claims from json")
 	}
 	m := NewMessageLaunch(registrationDS, cache, store, sessionName, debug)
-	m.cachedClaims = &claims
+	m.claims = claims
 	m.launchID = launchID
 
-	// save the launchID in the request context
+	// save the launchID and claims in the request context
 	newReq := requestWithLaunchIDContext(r, launchID)
-	*r = *newReq 
+	newReq = requestWithNewContextValue(newReq, launchClaimsKey, claims)
+	*r = *newReq
 
-	if err := m.validateClientID(*m.cachedClaims); err != nil {
+	if err := m.validateClientID(m.claims); err != nil {
 		return nil, errors.Wrap(err, "Cached message launch failed validation")
 	}
 	return m, nil
 }
 
+// Claims returns the typed claims of this message launch
+func (M *MessageLaunch) Claims() *LaunchClaims {
+	return M.claims
+}
+
 // GetNrps returns the name roles provisioning service associated with this message launch context
 func (M *MessageLaunch) GetNrps() (*NameRolesProvisioningService, error) {
 	nrpsClaim, err := M.getNrpsClaim()
@@ -75,7 +80,7 @@ func (M *MessageLaunch) GetNrps() (*NameRolesProvisioningService, error) {
 		return nil, errors.Wrap(err, "Failed to get NRPSvc: No claim")
 	}
 	svcConn := NewServiceConnector(*M.registration)
-	svc := NewNameRolesProvisioningService(svcConn, &nrpsClaim)
+	svc := NewNameRolesProvisioningService(svcConn, nrpsClaim)
 	return svc, nil
 }
 
@@ -86,33 +91,45 @@ func (M *MessageLaunch) GetAgs() (*AssignmentsGradeService, error) {
 		return nil, errors.Wrap(err, "Failed to get AgSvc: No claim")
 	}
 	svcConn := NewServiceConnector(*M.registration)
-	svc := NewAssignmentsGradeService(svcConn, &agsClaim)
+	svc := NewAssignmentsGradeService(svcConn, agsClaim)
 	return svc, nil
 }
 
-func (M *MessageLaunch) getNrpsClaim() (jwt.MapClaims, error) {
-	if M.cachedClaims == nil {
+// GetDeepLinkResponse returns a deep link response builder for this message launch, if it was a deep linking request
+func (M *MessageLaunch) GetDeepLinkResponse() (*DeepLinkResponse, error) {
+	if M.claims == nil {
+		return nil, fmt.Errorf("no cached claim exists for deep linking")
+	}
+	if !M.claims.IsDeepLinkLaunch() {
+		return nil, fmt.Errorf("message launch is not a deep linking request")
+	}
+	if M.claims.DeepLinkingSettings == nil {
+		return nil, fmt.Errorf("Failed to get DeepLinkResponse: deep link settings claim is missing")
+	}
+	return NewDeepLinkResponse(*M.registration, M.claims.DeploymentID, *M.claims.DeepLinkingSettings), nil
+}
+
+func (M *MessageLaunch) getNrpsClaim() (*NrpsServiceClaim, error) {
+	if M.claims == nil {
 		return nil, fmt.Errorf("no cached claim exists for nrps")
 	}
-	nrsMap, ok := (*M.cachedClaims)["https://purl.imsglobal.org/spec/lti-nrps/claim/namesroleservice"].(map[string]interface{})
-	if !ok {
+	if M.claims.NRPS == nil {
 		return nil, fmt.Errorf("nameroleservice claim is missing")
 	}
-	if nrsMap["context_memberships_url"].(string) == "" {
+	if M.claims.NRPS.ContextMembershipsURL == "" {
 		return nil, fmt.Errorf("nameroleservice claim has no context_memberships_url attribute")
 	}
-	return nrsMap, nil
+	return M.claims.NRPS, nil
 }
 
-func (M *MessageLaunch) getAgsClaim() (jwt.MapClaims, error) {
-	if M.cachedClaims == nil {
+func (M *MessageLaunch) getAgsClaim() (*AgsEndpointClaim, error) {
+	if M.claims == nil {
 		return nil, fmt.Errorf("no cached claim exists for ags")
 	}
-	agsMap, ok := (*M.cachedClaims)["https://purl.imsglobal.org/spec/lti-ags/claim/endpoint"].(map[string]interface{})
-	if !ok {
+	if M.claims.AGS == nil {
 		return nil, fmt.Errorf("lti-ags claim is missing")
 	}
-	return agsMap, nil
+	return M.claims.AGS, nil
 }
 
 func (M *MessageLaunch) validateState(req *http.Request) error {
@@ -131,114 +148,107 @@ func (M *MessageLaunch) validateState(req *http.Request) error {
 	return nil
 }
 
-func (M *MessageLaunch) validateNonce(req *http.Request, nonce string) error {
-	nonceOk := M.cache.CheckNonce(req, nonce)
-	if nonceOk {
-		return nil
+// NonceError is returned when the id_token nonce was not issued to this browser, has expired or was already used
+type NonceError struct {
+	Nonce string
+	Err   error
+}
+
+func (e *NonceError) Error() string {
+	return fmt.Sprintf("Invalid Nonce %q: %v", e.Nonce, e.Err)
+}
+
+// Unwrap returns the underlying cache error (eg: ltiCache.ErrNonceExpired)
+func (e *NonceError) Unwrap() error {
+	return e.Err
+}
+
+func (M *MessageLaunch) validateNonce(w http.ResponseWriter, req *http.Request, nonce string) error {
+	if nonce == "" {
+		return &NonceError{Nonce: nonce, Err: ltiCache.ErrNonceNotFound}
+	}
+	if err := M.cache.ConsumeNonce(w, req, nonce); err != nil {
+		log.Printf("nonce check failed: %v", err)
+		return &NonceError{Nonce: nonce, Err: err}
 	}
-	log.Printf("nonce check failed")
-	// platform is never sending the right nonce.
-	//  It's commented out in the php reference: https://github.com/IMSGlobal/lti-1-3-php-library/blob/1535dc1689121e37a18d843156fa449383255107/src/lti/lti_message_launch.php#L258
-	//  for now, skip the error. Maybe this will be fixed in the future.
-	// return fmt.Errorf("Invalid Nonce")
 	return nil
 }
 
-func (M *MessageLaunch) validateClientID(claims jwt.MapClaims) error {
-	var aud string
-	var audClaim interface{} = claims["aud"]
-	switch v := audClaim.(type) {
-	case string:
-		aud = v
-	case []string:
-		aud = v[0]
-	default:
-		log.Printf("aud claim is unexpected type: %T", v)
-	}
-	// get the issuer
-	iss := claims["iss"].(string)
+func (M *MessageLaunch) validateClientID(claims *LaunchClaims) error {
 	// check that the clientIds match
-	// note: to get this far, we know the issuer is in the claim, is a string and the registraton exists,
-	//   since the jwt was already validated and the issuer was used to find the public key
-	reg, _ := M.regDS.FindRegistration(iss)
-	if reg.ClientID != aud {
+	// note: the launch handler sets the registration the jwt was validated with, launches restored from the
+	//   cache find it again by issuer and client id
+	reg := M.registration
+	if reg == nil {
+		var err error
+		reg, err = findLaunchRegistration(M.regDS, claims.Issuer, claims.AuthorizedParty, claims.Audience)
+		if err != nil {
+			return errors.Wrap(err, "Unable to find issuer registration")
+		}
+	}
+	if !claims.Audience.Contains(reg.ClientID) {
 		return fmt.Errorf("ClientId does not match issuer registration")
 	}
 	M.registration = reg
 	return nil
 }
 
-func (M *MessageLaunch) validateDeployment(claims jwt.MapClaims) error {
-	depID := claims["https://purl.imsglobal.org/spec/lti/claim/deployment_id"].(string)
-	// get the issuer
-	iss := claims["iss"].(string)
-	// check that the clientIds match
-	// note: to get this far, we know the issuer is in the claim, is a string and the registraton exists,
-	//   since the jwt was already validated and the issuer was used to find the public key
-	dep, _ := M.regDS.FindDeployment(iss, depID)
+func (M *MessageLaunch) validateDeployment(claims *LaunchClaims) error {
+	// note: to get this far, we know the registration exists, since validateClientID found it
+	dep, _ := M.regDS.FindDeploymentByClientID(claims.Issuer, M.registration.ClientID, claims.DeploymentID)
 	if dep != nil {
 		return nil
 	}
-	return fmt.Errorf("Unable to find deployment %q", depID)
+	return fmt.Errorf("Unable to find deployment %q", claims.DeploymentID)
 }
 
-func (M *MessageLaunch) validateMessage(claims jwt.MapClaims) error {
-	msgType := claims["https://purl.imsglobal.org/spec/lti/claim/message_type"].(string)
-
-	switch msgType {
+func (M *MessageLaunch) validateMessage(claims *LaunchClaims) error {
+	switch claims.MessageType {
 	case "":
 		return fmt.Errorf("Empty message type not allowed")
-	case "LtiResourceLinkRequest":
+	case messageTypeResourceLink:
 		return M.validateMessageTypeLinkRequest(claims)
-	case "LtiDeepLinkingRequest":
+	case messageTypeDeepLinking:
 		return M.validateMessageTypeDeepLink(claims)
 	default:
-		return fmt.Errorf("unknown message type (%q)", msgType)
+		return fmt.Errorf("unknown message type (%q)", claims.MessageType)
 	}
 }
 
-func (M *MessageLaunch) validateMessageTypeLinkRequest(claims jwt.MapClaims) error {
+func (M *MessageLaunch) validateMessageTypeLinkRequest(claims *LaunchClaims) error {
 	if err := M.validateMessageTypeCommon(claims); err != nil {
 		return err
 	}
 
-	rlMap, ok := claims["https://purl.imsglobal.org/spec/lti/claim/resource_link"].(map[string]interface{})
-	if !ok {
+	if claims.ResourceLink == nil {
 		return fmt.Errorf("resource link claim is missing")
 	}
-	if rlMap["id"].(string) == "" {
+	if claims.ResourceLink.ID == "" {
 		return fmt.Errorf("resource link id is missing")
 	}
 	return nil
 }
 
-func (M *MessageLaunch) validateMessageTypeDeepLink(claims jwt.MapClaims) error {
+func (M *MessageLaunch) validateMessageTypeDeepLink(claims *LaunchClaims) error {
 	if err := M.validateMessageTypeCommon(claims); err != nil {
 		return err
 	}
 
-	dlsMap, ok := claims["https://purl.imsglobal.org/spec/lti-dl/claim/deep_linking_settings"].(map[string]interface{})
-	if !ok {
+	dls := claims.DeepLinkingSettings
+	if dls == nil {
 		return fmt.Errorf("deep link settings claim is missing")
 	}
-	if dlsMap["deep_link_return_url"].(string) == "" {
+	if dls.DeepLinkReturnURL == "" {
 		return fmt.Errorf("deep link return url is missing")
 	}
-	if dlsMap["accept_presentation_document_targets"].(string) == "" {
+	if len(dls.AcceptPresentationDocumentTargets) == 0 {
 		return fmt.Errorf("deep link presentation type missing")
 	}
-	types, ok := dlsMap["accept_types"].([]string)
-	if !ok {
+	if len(dls.AcceptTypes) == 0 {
 		return fmt.Errorf("missing types (accept_types)")
 	}
 	// types must include 'ltiResourceLink'
-	foundType := false
-	for _, t := range types {
-		if t == "ltiResourceLink" {
-			foundType = true
-		}
-	}
-	if !foundType {
+	if !dls.AcceptsType("ltiResourceLink") {
 		return fmt.Errorf("missing resource link placement types (accept_types)")
 	}
 
@@ -246,25 +256,15 @@ func (M *MessageLaunch) validateMessageTypeDeepLink(claims jwt.MapClaims) error
 }
 
 // validateMessageTypeCommon checks for claims that should be part of any message type
-func (M *MessageLaunch) validateMessageTypeCommon(claims jwt.MapClaims) error {
-	if claims["sub"].(string) == "" {
+func (M *MessageLaunch) validateMessageTypeCommon(claims *LaunchClaims) error {
+	if claims.Subject == "" {
 		return fmt.Errorf("token is missing user (sub) claim")
 	}
-	if claims["https://purl.imsglobal.org/spec/lti/claim/version"].(string) != "1.3.0" {
+	if claims.Version != "1.3.0" {
 		return fmt.Errorf("token has incompatible lti version")
 	}
-	if claims["https://purl.imsglobal.org/spec/lti/claim/roles"] == nil {
+	if claims.Roles == nil {
 		return fmt.Errorf("token is missing roles claim")
 	}
 	return nil
 }
-
-func (M *MessageLaunch) isDeepLinkLaunch(claims jwt.MapClaims) bool {
-	msgType := claims["https://purl.imsglobal.org/spec/lti/claim/message_type"].(string)
-	return msgType == "LtiDeepLinkingRequest"
-}
-
-func (M *MessageLaunch) isResourceLaunch(claims jwt.MapClaims) bool {
-	msgType := claims["https://purl.imsglobal.org/spec/lti/claim/message_type"].(string)
-	return msgType == "LtiResourceLinkRequest"
-}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"testing"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/GRT/lti-1-3-go-library/lti"
+
+	"github.com/golang-jwt/jwt/v4"
 )
 
 const (
@@ -37,3 +39,35 @@ func TestExploration(t *testing.T) {
 		t.Fatalf("resource link map should contain an id attribute (resource link: %v)", rl)
 	}
 }
+
+func TestLaunchClaims(t *testing.T) {
+	token, _ := jwt.Parse(tokenStr, nil)
+	claims, err := lti.NewLaunchClaims(token.Claims.(jwt.MapClaims))
+	if err != nil {
+		t.Fatalf("failed to create launch claims: %v", err)
+	}
+	if !claims.IsResourceLinkLaunch() {
+		t.Fatalf("expected a resource link launch, got message type: %q", claims.MessageType)
+	}
+	if !claims.Audience.Contains("testing12345") {
+		t.Fatalf("expected audience to contain the client id, got: %v", claims.Audience)
+	}
+	if claims.ResourceLink == nil || claims.ResourceLink.ID != "701" {
+		t.Fatalf("unexpected resource link claim: %+v", claims.ResourceLink)
+	}
+	if claims.Context == nil || claims.Context.ID != "141" {
+		t.Fatalf("unexpected context claim: %+v", claims.Context)
+	}
+	if claims.Custom["test"] != "testing" {
+		t.Fatalf("unexpected custom claim: %v", claims.Custom)
+	}
+	if claims.AGS == nil || claims.AGS.LineItems != "https://lti-ri.imsglobal.org/platforms/7/contexts/141/line_items" || len(claims.AGS.Scope) != 3 {
+		t.Fatalf("unexpected ags claim: %+v", claims.AGS)
+	}
+	if claims.NRPS == nil || claims.NRPS.ContextMembershipsURL != "https://lti-ri.imsglobal.org/platforms/7/contexts/141/memberships" {
+		t.Fatalf("unexpected nrps claim: %+v", claims.NRPS)
+	}
+	if claims.LaunchPresentation == nil || claims.LaunchPresentation.DocumentTarget != "iframe" {
+		t.Fatalf("unexpected launch presentation claim: %+v", claims.LaunchPresentation)
+	}
+}
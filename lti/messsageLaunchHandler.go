@@ -9,62 +9,78 @@ import (
 	"github.com/GRT/lti-1-3-go-library/ltiCache"
 	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
 
-	jwtmiddleware "github.com/auth0/go-jwt-middleware"
-	jwt "github.com/dgrijalva/jwt-go"
+	jwt "github.com/golang-jwt/jwt/v4"
 	"github.com/gorilla/sessions"
 )
 
 // MessageLaunchHandlerCreator returns a function that creates http handler functions that handle the LTI 1.3 message launch.
-// The function that the creator creates wraps a handler with middleware that grabs the JWT, validates it and
-// checks that it is a valid LTI Message Launch request
+// The function that the creator creates wraps a handler with a handler that grabs the JWT, verifies it (see IDTokenValidation.Verify)
+// and checks that it is a valid LTI Message Launch request
 func MessageLaunchHandlerCreator(registrationDS registrationDatastore.RegistrationDatastore, cache ltiCache.Cache, store sessions.Store, sessionName string, debug bool) func(http.Handler) http.Handler {
-	base := ltiBase{registrationDS, cache, store, sessionName}
+	return MessageLaunchHandlerCreatorWithValidation(registrationDS, cache, store, sessionName, debug, DefaultIDTokenValidation)
+}
+
+// MessageLaunchHandlerCreatorWithValidation is MessageLaunchHandlerCreator, with the given id_token leeway and max age
+// (rather than DefaultIDTokenValidation)
+func MessageLaunchHandlerCreatorWithValidation(registrationDS registrationDatastore.RegistrationDatastore, cache ltiCache.Cache, store sessions.Store, sessionName string, debug bool, validation IDTokenValidation) func(http.Handler) http.Handler {
+	extractToken := FromAnyParameter("id_token")
 	return func(handla http.Handler) http.Handler {
-		// initialize the jwt middleware
-		opts := jwtmiddleware.Options{
-			SigningMethod:       jwt.SigningMethodRS256,
-			UserProperty:        userKeyName,
-			Extractor:           FromAnyParameter("id_token"),
-			Debug:               debug,
-			ValidationKeyGetter: base.getValidationKey,
-			ErrorHandler:        tokenMWErrorHandler,
-		}
-		jwtMW := jwtmiddleware.New(opts)
-		// now create the inner handler
 		handlerFunc := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			tokenStr, err := extractToken(req)
+			if err == nil && tokenStr == "" {
+				err = fmt.Errorf("Required authorization token not found")
+			}
+			if err != nil {
+				tokenErrorHandler(w, req, err)
+				return
+			}
+			claims, reg, err := validation.Verify(registrationDS, tokenStr)
+			if err != nil {
+				if debug {
+					log.Printf("id_token verification failed: %v", err)
+				}
+				tokenErrorHandler(w, req, err)
+				return
+			}
+			req = requestWithNewContextValue(req, idTokenClaimsKey, claims)
+
 			// create this request handler's messageLaunch object
 			msgL := NewMessageLaunch(registrationDS, cache, store, sessionName, debug)
+			msgL.registration = reg
 			sess, _ := msgL.store.Get(req, msgL.ltiBase.sessionName)
 
-			// get id_token claims (which was validated and placed in the context by jwt middleware)
-			claims := GetClaims(req)
+			launchClaims, err := NewLaunchClaims(claims)
+			if err != nil {
+				http.Error(w, err.Error(), 401)
+				return
+			}
 
-			// Note: token validity, security, expired handled by wrapper
+			// Note: token signature and expiry were checked by validation.Verify
 			if err := msgL.validateState(req); err != nil {
 				http.Error(w, err.Error(), 401)
 				return
 			}
 			// validate the nonce
-			tokNonce := claims["nonce"].(string)
-			if err := msgL.validateNonce(req, tokNonce); err != nil {
+			if err := msgL.validateNonce(w, req, launchClaims.Nonce); err != nil {
 				http.Error(w, err.Error(), 401)
 				return
 			}
 
-			if err := msgL.validateClientID(GetClaims(req)); err != nil {
+			if err := msgL.validateClientID(launchClaims); err != nil {
 				http.Error(w, err.Error(), 401)
 				return
 			}
 
-			if err := msgL.validateDeployment(GetClaims(req)); err != nil {
+			if err := msgL.validateDeployment(launchClaims); err != nil {
 				http.Error(w, err.Error(), 401)
 				return
 			}
 
-			if err := msgL.validateMessage(GetClaims(req)); err != nil {
+			if err := msgL.validateMessage(launchClaims); err != nil {
 				http.Error(w, err.Error(), 401)
 				return
 			}
+			msgL.claims = launchClaims
 
 			bytes, err := json.Marshal(claims)
 			if err != nil {
@@ -76,30 +92,38 @@ func MessageLaunchHandlerCreator(registrationDS registrationDatastore.Registrati
 			log.Printf("launchData length: %d", len(claimsStr))
 			// log.Printf("launchData: %s", claimsStr)
 			msgL.cache.PutLaunchData(req, msgL.launchID, string(bytes))
-			// save the launchID in the request context
+			// save the launchID and claims in the request context
 			req = requestWithLaunchIDContext(req, msgL.launchID)
+			req = requestWithNewContextValue(req, launchClaimsKey, launchClaims)
 			if err := sess.Save(req, w); err != nil {
 				log.Printf("error while saving session: %v", err)
 			}
 			handla.ServeHTTP(w, req)
 		})
-		return jwtMW.Handler(handlerFunc)
+		return handlerFunc
 	}
 }
 
-func tokenMWErrorHandler(w http.ResponseWriter, r *http.Request, err string) {
-	http.Error(w, fmt.Sprintf("Token issue: %s", err), 401)
+func tokenErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, fmt.Sprintf("Token issue: %v", err), 401)
 }
 
-// GetClaims fetches the user's jwt claims from the context. It fetches it from the JWT that
-// the jwt middleware stored in the request context
+// GetClaims fetches the user's jwt claims from the context, where the message launch handler stored them
+// once the id_token was verified.  It returns nil for requests that weren't launches.
 func GetClaims(req *http.Request) jwt.MapClaims {
-	userToken := req.Context().Value(userKeyName)
-	tok := userToken.(*jwt.Token)
-	claims := tok.Claims.(jwt.MapClaims)
+	claims, _ := req.Context().Value(idTokenClaimsKey).(jwt.MapClaims)
 	return claims
 }
 
+// GetLaunchClaims fetches the typed launch claims associated with this request.  They are stored in the request context
+// by the message launch handler, or when a message launch is restored from the cache.
+func GetLaunchClaims(req *http.Request) *LaunchClaims {
+	if lc, ok := req.Context().Value(launchClaimsKey).(*LaunchClaims); ok {
+		return lc
+	}
+	return nil
+}
+
 // GetLaunchID fetches the launchID associated with this request.  It is stored in the request context if present.
 func GetLaunchID(req *http.Request) string {
 	if lid := req.Context().Value(launchIDKey); lid != nil {
@@ -110,8 +134,11 @@ func GetLaunchID(req *http.Request) string {
 	return ""
 }
 
+// TokenExtractor gets the jwt from a request, returning "" if there isn't one
+type TokenExtractor func(r *http.Request) (string, error)
+
 // FromAnyParameter returns a TokenExtractor that fetches the jwt from the body of the post or the query param
-func FromAnyParameter(param string) jwtmiddleware.TokenExtractor {
+func FromAnyParameter(param string) TokenExtractor {
 	return func(r *http.Request) (string, error) {
 		return r.FormValue(param), nil
 	}
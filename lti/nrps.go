@@ -1,27 +1,32 @@
 package lti
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
-	"regexp"
-	"strings"
+	"net/url"
+	"strconv"
 	"github.com/GRT/lti-1-3-go-library/ltiCache"
 	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
 
-	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/sessions"
 	"github.com/pkg/errors"
 )
 
+const nrpsMediaType = "application/vnd.ims.lti-nrps.v2.membershipcontainer+json"
+
+var nrpsScopes = []string{"https://purl.imsglobal.org/spec/lti-nrps/scope/contextmembership.readonly"}
+
 // NameRolesProvisioningService offers the endpoints as specified in lti13
 type NameRolesProvisioningService struct {
 	svcConn *ServiceConnector
-	svcData *jwt.MapClaims
+	svcData *NrpsServiceClaim
 }
 
 // NewNameRolesProvisioningService creates a new NameRolesProvisioningService
-func NewNameRolesProvisioningService(conn *ServiceConnector, data *jwt.MapClaims) *NameRolesProvisioningService {
+func NewNameRolesProvisioningService(conn *ServiceConnector, data *NrpsServiceClaim) *NameRolesProvisioningService {
 	return &NameRolesProvisioningService{svcConn: conn, svcData: data}
 }
 
@@ -30,77 +35,255 @@ type NrpsMemberResponse struct {
 	ID      string       `json:"id"`
 	Context NrpsContext  `json:"context"`
 	Members []NrpsMember `json:"members"`
+	// DifferencesURL is the platform's rel="differences" link, for fetching only the changes since this response
+	DifferencesURL string `json:"-"`
 }
 
+// NrpsMemberStatus is a member's status in the context
+type NrpsMemberStatus string
+
+// The member statuses defined by the NRPS spec, a member without a status is Active
+const (
+	NrpsMemberActive   NrpsMemberStatus = "Active"
+	NrpsMemberInactive NrpsMemberStatus = "Inactive"
+	NrpsMemberDeleted  NrpsMemberStatus = "Deleted"
+)
+
 // NrpsContext contains context info for getMembers call
 type NrpsContext struct {
-	ID    int    `json:"id"`
+	ID    string `json:"id"`
 	Label string `json:"label"`
 	Title string `json:"title"`
 }
 
 // NrpsMember contains attributes for a single member
 type NrpsMember struct {
-	Name               string   `json:"name"`
-	Picture            string   `json:"picture"`
-	GivenName          string   `json:"given_name"`
-	FamilyName         string   `json:"family_name"`
-	MiddleName         string   `json:"middle_name"`
-	Email              string   `json:"email"`
-	UserID             string   `json:"user_id"`
-	LisPersonSourcedid string   `json:"lis_person_sourcedid"`
-	Roles              []string `json:"roles"`
-}
-
-// GetMembers uses the Message Launches context and auth token to return a list of users associated with this launch
-func (s *NameRolesProvisioningService) GetMembers() (*NrpsMemberResponse, error) {
-	svcURL := (*s.svcData)["context_memberships_url"].(string)
-	svcScopes := []string{"https://purl.imsglobal.org/spec/lti-nrps/scope/contextmembership.readonly"}
-	retval := &NrpsMemberResponse{}
-	linkRegex := regexp.MustCompile("^?<(.*)>; ?rel=\"next\"$")
+	Name               string `json:"name"`
+	Picture            string `json:"picture"`
+	GivenName          string `json:"given_name"`
+	FamilyName         string `json:"family_name"`
+	MiddleName         string `json:"middle_name"`
+	Email              string `json:"email"`
+	UserID             string `json:"user_id"`
+	LisPersonSourcedid string `json:"lis_person_sourcedid"`
+	Roles              Roles  `json:"roles"`
+	// Status is omitted by platforms for active members, see IsActive
+	Status NrpsMemberStatus `json:"status,omitempty"`
+	// Message holds the member's launch claims, sent when the memberships were fetched for a resource link
+	Message []NrpsMemberMessage `json:"message,omitempty"`
+}
+
+// NrpsMemberMessage holds the claims a member would receive when launching the resource link
+type NrpsMemberMessage struct {
+	MessageType  string             `json:"https://purl.imsglobal.org/spec/lti/claim/message_type"`
+	Custom       CustomClaim        `json:"https://purl.imsglobal.org/spec/lti/claim/custom,omitempty"`
+	Lis          *LisClaim          `json:"https://purl.imsglobal.org/spec/lti/claim/lis,omitempty"`
+	BasicOutcome *BasicOutcomeClaim `json:"https://purl.imsglobal.org/spec/lti-bo/claim/basicoutcome,omitempty"`
+	// Claims holds every claim of the message, including ones without a field above
+	Claims map[string]json.RawMessage `json:"-"`
+}
+
+// BasicOutcomeClaim holds the LTI 1.1 basic outcome service details, for tools migrating from LTI 1.1
+type BasicOutcomeClaim struct {
+	LisResultSourcedID   string `json:"lis_result_sourcedid,omitempty"`
+	LisOutcomeServiceURL string `json:"lis_outcome_service_url,omitempty"`
+}
+
+// MembersOptions are the (optional) filters for fetching members
+type MembersOptions struct {
+	// Role limits the members to those with the role, given as its full URI
+	// (eg: "http://purl.imsglobal.org/vocab/lis/v2/membership#Learner")
+	Role string
+	// Limit is the page size asked of the platform, all pages are still fetched
+	Limit int
+	// ResourceLinkID fetches the members of the resource link rather than the context, with their message claims
+	ResourceLinkID string
+}
+
+// UnmarshalJSON decodes the typed claims, and keeps all of them in Claims
+func (m *NrpsMemberMessage) UnmarshalJSON(data []byte) error {
+	type typedMessage NrpsMemberMessage
+	var typed typedMessage
+	if err := json.Unmarshal(data, &typed); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &typed.Claims); err != nil {
+		return err
+	}
+	*m = NrpsMemberMessage(typed)
+	return nil
+}
+
+// MarshalJSON writes all the message's claims
+func (m NrpsMemberMessage) MarshalJSON() ([]byte, error) {
+	if m.Claims != nil {
+		return json.Marshal(m.Claims)
+	}
+	type typedMessage NrpsMemberMessage
+	return json.Marshal(typedMessage(m))
+}
+
+// IsActive returns true if the member is active in the context (platforms may leave out the Active status)
+func (m NrpsMember) IsActive() bool {
+	return m.Status == "" || m.Status == NrpsMemberActive
+}
+
+// GetMembers uses the Message Launches context and auth token to return a list of users associated with this launch.
+// opts may be nil.  Every page is held in memory, use ForEachMember for large rosters.  Paging stops if the context is done.
+func (s *NameRolesProvisioningService) GetMembers(ctx context.Context, opts *MembersOptions) (*NrpsMemberResponse, error) {
+	svcURL, err := s.membersURL(opts)
+	if err != nil {
+		return nil, err
+	}
+	return s.collectMembers(ctx, svcURL)
+}
+
+// GetMembersSince fetches the membership changes since the response that gave the differences url: members added
+// or changed (including those now Inactive or Deleted).  The returned response has the differences url for next time.
+func (s *NameRolesProvisioningService) GetMembersSince(ctx context.Context, differencesURL string) (*NrpsMemberResponse, error) {
+	return s.collectMembers(ctx, differencesURL)
+}
+
+// ForEachMember calls fn for each member, fetching one page at a time so only a page is held in memory.
+// Paging stops if the context is done or fn returns an error, and that error is returned.
+func (s *NameRolesProvisioningService) ForEachMember(ctx context.Context, opts *MembersOptions, fn func(NrpsMember) error) error {
+	return s.ForEachMemberPage(ctx, opts, func(page *NrpsMemberResponse) error {
+		for _, member := range page.Members {
+			if err := fn(member); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ForEachMemberPage calls fn with each page of members as it is fetched.  Every page has the response's id and context,
+// and DifferencesURL is set on the page that carried the differences link.
+// Paging stops if the context is done or fn returns an error, and that error is returned.
+func (s *NameRolesProvisioningService) ForEachMemberPage(ctx context.Context, opts *MembersOptions, fn func(*NrpsMemberResponse) error) error {
+	svcURL, err := s.membersURL(opts)
+	if err != nil {
+		return err
+	}
+	return s.forEachPage(ctx, svcURL, fn)
+}
+
+func (s *NameRolesProvisioningService) collectMembers(ctx context.Context, svcURL string) (*NrpsMemberResponse, error) {
+	retval := &NrpsMemberResponse{Members: make([]NrpsMember, 0)}
 	count := 0
-	for svcURL != "" {
+	err := s.forEachPage(ctx, svcURL, func(page *NrpsMemberResponse) error {
 		count++
-		res, err := s.svcConn.DoServiceRequest(svcScopes, svcURL, "GET", "", "", "")
+		if count == 1 {
+			retval.Context = page.Context
+			retval.ID = page.ID
+		}
+		retval.Members = append(retval.Members, page.Members...)
+		if page.DifferencesURL != "" {
+			retval.DifferencesURL = page.DifferencesURL
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return retval, nil
+}
+
+// forEachPage fetches svcURL and the pages that follow it (from the rel="next" links), passing each to fn
+func (s *NameRolesProvisioningService) forEachPage(ctx context.Context, svcURL string, fn func(*NrpsMemberResponse) error) error {
+	for count := 1; svcURL != ""; count++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		res, err := s.svcConn.Do(ctx, ServiceRequest{URL: svcURL, Scopes: nrpsScopes, Accept: nrpsMediaType})
 		if err != nil {
-			return nil, errors.Wrapf(err, "Failed to fetch member fetch #%d", count)
+			return errors.Wrapf(err, "Failed to fetch member fetch #%d", count)
 		}
 		log.Printf("------ nrps (%s) iteration %d success, body len: %d --------------", svcURL, count, len(res.Body))
-		log.Printf("  body: %+v", res.Body)
-		resp := &NrpsMemberResponse{}
-		if err := json.Unmarshal([]byte(res.Body), resp); err != nil {
-			return nil, errors.Wrapf(err, "failed to parse json, fetch #%d", count)
+		page := &NrpsMemberResponse{}
+		if err := json.Unmarshal([]byte(res.Body), page); err != nil {
+			return errors.Wrapf(err, "failed to parse json, fetch #%d", count)
 		}
-		if count == 1 {
-			retval.Context = resp.Context
-			retval.ID = resp.ID
-			retval.Members = make([]NrpsMember, 5)
+		page.DifferencesURL = res.Link("differences")
+		if err := fn(page); err != nil {
+			return err
 		}
-		retval.Members = append(retval.Members, resp.Members...)
-		svcURL = ""
-
-	HeaderLoop:
-		for k, v := range res.Header {
-			log.Printf("header: %s: %v", k, v)
-			hKey := strings.ToLower(k)
-			if hKey == "link" {
-				log.Printf("link header for url(%q) found: %s: %v", svcURL, k, v)
-				for _, link := range v {
-					if res := linkRegex.FindSubmatch([]byte(link)); res != nil {
-						nextURL := string(res[1])
-						log.Printf("Next Url determined: %v", nextURL)
-						svcURL = nextURL
-						break HeaderLoop
-					}
-				}
+		svcURL = res.Link("next")
+		log.Printf("Next Url determined: %v", svcURL)
+	}
+	return nil
+}
+
+// streamMembers writes the members as a json NrpsMemberResponse, flushing each page as it arrives.  If paging fails
+// after the response has started, the json is left unterminated so the client can't mistake it for the whole roster.
+func streamMembers(ctx context.Context, w http.ResponseWriter, svc *NameRolesProvisioningService, opts *MembersOptions) error {
+	flusher, _ := w.(http.Flusher)
+	started, separator := false, ""
+	start := func(page *NrpsMemberResponse) error {
+		idJSON, _ := json.Marshal(page.ID)
+		contextJSON, err := json.Marshal(page.Context)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":%s,"context":%s,"members":[`, idJSON, contextJSON)
+		started = true
+		return nil
+	}
+	err := svc.ForEachMemberPage(ctx, opts, func(page *NrpsMemberResponse) error {
+		if !started {
+			if err := start(page); err != nil {
+				return err
 			}
 		}
+		for _, member := range page.Members {
+			b, err := json.Marshal(member)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s%s", separator, b)
+			separator = ","
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("streaming members failed: %v", err)
+		if !started {
+			http.Error(w, err.Error(), 500)
+		}
+		return err
 	}
-	return retval, nil
+	if !started {
+		// no pages were fetched, the roster is empty
+		start(&NrpsMemberResponse{})
+	}
+	w.Write([]byte("]}"))
+	return nil
+}
+
+// membersURL adds the options' query params to the context memberships url
+func (s *NameRolesProvisioningService) membersURL(opts *MembersOptions) (string, error) {
+	params := url.Values{}
+	if opts != nil {
+		if opts.Role != "" {
+			params.Set("role", opts.Role)
+		}
+		if opts.Limit > 0 {
+			params.Set("limit", strconv.Itoa(opts.Limit))
+		}
+		if opts.ResourceLinkID != "" {
+			params.Set("rlid", opts.ResourceLinkID)
+		}
+	}
+	return addQueryParams(s.svcData.ContextMembershipsURL, params)
 }
 
 // NrpsGetMemberHandlerCreator returns a function which creates an http.Handler that uses a cached LTI Message launch's name role provisioning service
 //  to fetch a list of users from that context.
+// Expected method: Get, params: launchId, role (optional), limit (optional), rlid (optional)
 func NrpsGetMemberHandlerCreator(registrationDS registrationDatastore.RegistrationDatastore, cache ltiCache.Cache, store sessions.Store, sessionName string, debug bool) func(http.Handler) http.Handler {
 	return func(handla http.Handler) http.Handler {
 		handlerFunc := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -115,20 +298,16 @@ func NrpsGetMemberHandlerCreator(registrationDS registrationDatastore.Registrati
 				http.Error(w, err.Error(), 404)
 				return
 			}
-			res, err := svc.GetMembers()
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
+			opts := &MembersOptions{Role: req.FormValue("role"), ResourceLinkID: req.FormValue("rlid")}
+			if limit := req.FormValue("limit"); limit != "" {
+				if opts.Limit, err = strconv.Atoi(limit); err != nil {
+					http.Error(w, "limit param must be a number", 400)
+					return
+				}
 			}
-			// log.Printf("res to be serialized: %+v", res)
-			// serialize the result
-			b, err := json.Marshal(res)
-			if err != nil {
-				http.Error(w, err.Error(), 500)
+			if err := streamMembers(req.Context(), w, svc, opts); err != nil {
 				return
 			}
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(b)
 			// Invoke the passed in handler if it's there
 			// Not much for it to do at this point
 			if handla != nil {
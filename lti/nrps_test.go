@@ -0,0 +1,96 @@
+package lti_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/GRT/lti-1-3-go-library/lti"
+)
+
+func TestGetMembersOptions(t *testing.T) {
+	platform, conn := newTestPlatform(t, func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		if q.Get("role") != "http://purl.imsglobal.org/vocab/lis/v2/membership#Learner" || q.Get("limit") != "50" || q.Get("rlid") != "rl1" {
+			http.Error(w, fmt.Sprintf("unexpected query: %v", q), 400)
+			return
+		}
+		fmt.Fprint(w, `{"id": "m1", "context": {"id": "ctx1"}, "members": [
+			{"user_id": "u1", "roles": ["http://purl.imsglobal.org/vocab/lis/v2/membership#Learner"], "status": "Inactive",
+			 "message": [{
+				"https://purl.imsglobal.org/spec/lti/claim/message_type": "LtiResourceLinkRequest",
+				"https://purl.imsglobal.org/spec/lti/claim/custom": {"country": "Canada", "points": 10},
+				"https://purl.imsglobal.org/spec/lti/claim/lis": {"person_sourcedid": "sis-u1"},
+				"https://purl.imsglobal.org/spec/lti-bo/claim/basicoutcome": {"lis_result_sourcedid": "rs-u1"},
+				"https://example.com/claim/extra": "kept"
+			 }]}]}`)
+	})
+	defer platform.Close()
+
+	svc := lti.NewNameRolesProvisioningService(conn, &lti.NrpsServiceClaim{ContextMembershipsURL: platform.URL + "/members"})
+	res, err := svc.GetMembers(context.Background(), &lti.MembersOptions{Role: lti.ContextRoleURI(lti.RoleLearner), Limit: 50, ResourceLinkID: "rl1"})
+	if err != nil {
+		t.Fatalf("GetMembers failed: %v", err)
+	}
+	var member *lti.NrpsMember
+	for i, m := range res.Members {
+		if m.UserID == "u1" {
+			member = &res.Members[i]
+		}
+	}
+	if member == nil || member.Status != lti.NrpsMemberInactive || member.IsActive() || !member.Roles.IsLearner() {
+		t.Fatalf("unexpected member: %+v", member)
+	}
+	if len(member.Message) != 1 {
+		t.Fatalf("expected the member's message to be decoded, got: %+v", member.Message)
+	}
+	msg := member.Message[0]
+	if msg.MessageType != "LtiResourceLinkRequest" || msg.Custom["country"] != "Canada" || msg.Custom["points"] != "10" ||
+		msg.Lis == nil || msg.Lis.PersonSourcedID != "sis-u1" || msg.BasicOutcome == nil || msg.BasicOutcome.LisResultSourcedID != "rs-u1" {
+		t.Fatalf("unexpected member message: %+v", msg)
+	}
+	if string(msg.Claims["https://example.com/claim/extra"]) != `"kept"` {
+		t.Fatalf("claims without a field should be kept, got: %v", msg.Claims)
+	}
+}
+
+func TestForEachMember(t *testing.T) {
+	fetches := 0
+	var platform *httptest.Server
+	platform, conn := newTestPlatform(t, func(w http.ResponseWriter, req *http.Request) {
+		fetches++
+		page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+		if page < 2 {
+			w.Header().Set("Link", fmt.Sprintf(`<%s/members?page=%d>; rel="next"`, platform.URL, page+1))
+		}
+		fmt.Fprintf(w, `{"id": "m1", "context": {"id": "ctx1"}, "members": [{"user_id": "p%d-a"}, {"user_id": "p%d-b"}]}`, page, page)
+	})
+	defer platform.Close()
+	svc := lti.NewNameRolesProvisioningService(conn, &lti.NrpsServiceClaim{ContextMembershipsURL: platform.URL + "/members"})
+
+	res, err := svc.GetMembers(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("GetMembers failed: %v", err)
+	}
+	if len(res.Members) != 6 || res.Members[0].UserID != "p0-a" || res.Context.ID != "ctx1" {
+		t.Fatalf("expected the 6 members of the 3 pages (and no blanks), got: %+v", res.Members)
+	}
+
+	fetches = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	seen := make([]string, 0)
+	err = svc.ForEachMember(ctx, nil, func(member lti.NrpsMember) error {
+		seen = append(seen, member.UserID)
+		cancel()
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected paging to stop when the context is cancelled, got: %v", err)
+	}
+	if fetches != 1 || len(seen) != 2 {
+		t.Fatalf("expected only the first page to be fetched, fetches: %d, members seen: %v", fetches, seen)
+	}
+}
@@ -92,6 +92,10 @@ func (O *OidcLogin) validateOidcLogin(req *http.Request) (*registrationDatastore
 	if loginHint == "" {
 		return nil, fmt.Errorf("login hint not found")
 	}
+	// platforms with several registrations of the tool send the client id to say which one
+	if clientID := req.FormValue("client_id"); clientID != "" {
+		return O.regDS.FindRegistrationByClientID(iss, clientID)
+	}
 	return O.regDS.FindRegistration(iss)
 }
 
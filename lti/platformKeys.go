@@ -0,0 +1,64 @@
+package lti
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/pkg/errors"
+)
+
+// PlatformValidationKey returns the platform public key to validate a token with the given kid.  The registration's sources are
+// tried in turn: its inline PlatformJWKS, its KeySetURL (through DefaultKeySetManager), then its PEM PlatformPublicKey,
+// which has no kid so is used for any token the other sources have no key for.
+func PlatformValidationKey(reg registrationDatastore.Registration, kid string) (interface{}, error) {
+	key, _, err := lookupPlatformKey(reg, kid)
+	return key, err
+}
+
+// lookupPlatformKey is PlatformValidationKey, also returning the alg of the JWK the key came from ("" when the JWK
+// had no alg, or the key is the PEM key)
+func lookupPlatformKey(reg registrationDatastore.Registration, kid string) (interface{}, string, error) {
+	if !reg.HasPlatformKeys() {
+		return nil, "", fmt.Errorf("No platform keys (keySetUrl, platformJwks or platformPublicKey) registered for issuer: %q", reg.Issuer)
+	}
+	var lookupErr error
+	if len(reg.PlatformJWKS) > 0 {
+		keyset, err := jwk.ParseBytes(reg.PlatformJWKS)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "Failed parsing the platform JWKS registered for issuer: %q", reg.Issuer)
+		}
+		key := lookupKeyID(keyset, kid)
+		// a token without a kid can only be matched to a lone key
+		if key == nil && kid == "" && len(keyset.Keys) == 1 {
+			key = keyset.Keys[0]
+		}
+		if key != nil {
+			return materializeKey(key, kid)
+		}
+		lookupErr = fmt.Errorf("Token validation key not found in the registered platform JWKS for kid: %q", kid)
+	}
+	if reg.KeySetURL != "" {
+		log.Printf("pubkey url: %s", reg.KeySetURL)
+		key, err := DefaultKeySetManager.LookupKey(reg.KeySetURL, kid)
+		if err == nil {
+			return materializeKey(key, kid)
+		}
+		lookupErr = err
+	}
+	if reg.PlatformPublicKey != "" {
+		key, err := reg.ParsePlatformPublicKey()
+		return key, "", err
+	}
+	return nil, "", lookupErr
+}
+
+func materializeKey(key jwk.Key, kid string) (interface{}, string, error) {
+	materializedKey, err := key.Materialize()
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "Could not materialize key for kid: %q", kid)
+	}
+	return materializedKey, key.Algorithm(), nil
+}
@@ -0,0 +1,49 @@
+package lti_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+
+	"github.com/GRT/lti-1-3-go-library/lti"
+	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+func TestPlatformValidationKey(t *testing.T) {
+	inlineKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	pemKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	key, _ := jwk.New(&inlineKey.PublicKey)
+	key.Set(jwk.KeyIDKey, "inline")
+	jwks, _ := json.Marshal(jwk.Set{Keys: []jwk.Key{key}})
+	pkix, _ := x509.MarshalPKIXPublicKey(&pemKey.PublicKey)
+
+	// no KeySetURL, so no outbound http
+	reg := registrationDatastore.Registration{Issuer: "https://platform.example.com", PlatformJWKS: jwks}
+	if got, err := lti.PlatformValidationKey(reg, "inline"); err != nil || got.(*rsa.PublicKey).N.Cmp(inlineKey.N) != 0 {
+		t.Fatalf("expected the inline key, got: %v, %v", got, err)
+	}
+	if got, err := lti.PlatformValidationKey(reg, ""); err != nil || got.(*rsa.PublicKey).N.Cmp(inlineKey.N) != 0 {
+		t.Fatalf("expected a token without a kid to use the lone inline key, got: %v, %v", got, err)
+	}
+	if _, err := lti.PlatformValidationKey(reg, "other"); err == nil {
+		t.Fatalf("expected an unknown kid to fail")
+	}
+
+	// the PEM key is used for kids the JWKS doesn't have
+	reg.PlatformPublicKey = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}))
+	if got, err := lti.PlatformValidationKey(reg, "other"); err != nil || got.(*rsa.PublicKey).N.Cmp(pemKey.N) != 0 {
+		t.Fatalf("expected the PEM key, got: %v, %v", got, err)
+	}
+	if got, err := lti.PlatformValidationKey(reg, "inline"); err != nil || got.(*rsa.PublicKey).N.Cmp(inlineKey.N) != 0 {
+		t.Fatalf("expected the inline key to be preferred, got: %v, %v", got, err)
+	}
+
+	if _, err := lti.PlatformValidationKey(registrationDatastore.Registration{Issuer: "https://platform.example.com"}, "inline"); err == nil {
+		t.Fatalf("expected an error for a registration without platform keys")
+	}
+}
@@ -0,0 +1,53 @@
+package lti
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter spaces calls out evenly, so they don't exceed a number per second.  Share one between the PutGrades
+// calls that should be limited together, eg: one per registration.  It is safe for concurrent use.
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing requestsPerSecond calls a second
+func NewRateLimiter(requestsPerSecond float64) *RateLimiter {
+	r := &RateLimiter{}
+	r.SetRate(requestsPerSecond)
+	return r
+}
+
+// SetRate changes the calls allowed a second, zero or less means no limit
+func (r *RateLimiter) SetRate(requestsPerSecond float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if requestsPerSecond <= 0 {
+		r.interval = 0
+		return
+	}
+	r.interval = time.Duration(float64(time.Second) / requestsPerSecond)
+}
+
+// Wait blocks until the caller may make its call, returning the context's error if it is done first
+func (r *RateLimiter) Wait(ctx context.Context) error {
+	r.mu.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	delay := r.next.Sub(now)
+	r.next = r.next.Add(r.interval)
+	r.mu.Unlock()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
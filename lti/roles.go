@@ -0,0 +1,210 @@
+package lti
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// RoleVocabulary is the LIS vocabulary a role belongs to
+type RoleVocabulary string
+
+// The LIS v2 role vocabularies
+const (
+	RoleVocabularySystem      RoleVocabulary = "system"
+	RoleVocabularyInstitution RoleVocabulary = "institution"
+	RoleVocabularyContext     RoleVocabulary = "context"
+	RoleVocabularyUnknown     RoleVocabulary = ""
+)
+
+const (
+	lisV2SystemPrefix      = "http://purl.imsglobal.org/vocab/lis/v2/system/person#"
+	lisV2InstitutionPrefix = "http://purl.imsglobal.org/vocab/lis/v2/institution/person#"
+	lisV2ContextPrefix     = "http://purl.imsglobal.org/vocab/lis/v2/membership#"
+	// context sub-roles look like: http://purl.imsglobal.org/vocab/lis/v2/membership/Instructor#TeachingAssistant
+	lisV2ContextSubRolePrefix = "http://purl.imsglobal.org/vocab/lis/v2/membership/"
+	// the lti 1.1 urn forms, still sent by some platforms
+	lti11SystemPrefix      = "urn:lti:sysrole:ims/lis/"
+	lti11InstitutionPrefix = "urn:lti:instrole:ims/lis/"
+	lti11ContextPrefix     = "urn:lti:role:ims/lis/"
+)
+
+// role names, as used in the LIS v2 vocabularies
+const (
+	RoleAdministrator     = "Administrator"
+	RoleContentDeveloper  = "ContentDeveloper"
+	RoleInstructor        = "Instructor"
+	RoleLearner           = "Learner"
+	RoleMentor            = "Mentor"
+	RoleManager           = "Manager"
+	RoleMember            = "Member"
+	RoleOfficer           = "Officer"
+	RoleFaculty           = "Faculty"
+	RoleStudent           = "Student"
+	RoleStaff             = "Staff"
+	RoleSysAdmin          = "SysAdmin"
+	RoleTeachingAssistant = "TeachingAssistant"
+)
+
+// the context role names that may be sent as a bare name (eg: "Instructor")
+var contextRoleNames = map[string]bool{
+	RoleAdministrator:    true,
+	RoleContentDeveloper: true,
+	RoleInstructor:       true,
+	RoleLearner:          true,
+	RoleMentor:           true,
+	RoleManager:          true,
+	RoleMember:           true,
+	RoleOfficer:          true,
+}
+
+// ContextRoleURI returns the full LIS v2 URI of a context role name (eg: RoleLearner), as used in NRPS role filters
+func ContextRoleURI(name string) string {
+	return lisV2ContextPrefix + name
+}
+
+// Role is a single parsed LTI role
+type Role struct {
+	// URI is the role exactly as the platform sent it
+	URI        string
+	Vocabulary RoleVocabulary
+	// Name is the principal role name, eg: "Instructor"
+	Name string
+	// SubRole is the sub-role name, if any, eg: "TeachingAssistant"
+	SubRole string
+}
+
+// ParseRole parses a role URI from the LIS v2 system, institution or context vocabularies.  The lti 1.1 urn forms
+// and bare context role names (eg: "Instructor" or "Instructor#TeachingAssistant") are accepted as well.
+// Roles that can't be recognized have the RoleVocabularyUnknown vocabulary and the full value as the name.
+func ParseRole(uri string) Role {
+	role := Role{URI: uri}
+	switch {
+	case strings.HasPrefix(uri, lisV2SystemPrefix):
+		role.Vocabulary = RoleVocabularySystem
+		role.Name = strings.TrimPrefix(uri, lisV2SystemPrefix)
+	case strings.HasPrefix(uri, lisV2InstitutionPrefix):
+		role.Vocabulary = RoleVocabularyInstitution
+		role.Name = strings.TrimPrefix(uri, lisV2InstitutionPrefix)
+	case strings.HasPrefix(uri, lisV2ContextPrefix):
+		role.Vocabulary = RoleVocabularyContext
+		role.Name = strings.TrimPrefix(uri, lisV2ContextPrefix)
+	case strings.HasPrefix(uri, lisV2ContextSubRolePrefix):
+		role.Vocabulary = RoleVocabularyContext
+		role.Name, role.SubRole = splitSubRole(strings.TrimPrefix(uri, lisV2ContextSubRolePrefix), "#")
+	case strings.HasPrefix(uri, lti11SystemPrefix):
+		role.Vocabulary = RoleVocabularySystem
+		role.Name = strings.TrimPrefix(uri, lti11SystemPrefix)
+	case strings.HasPrefix(uri, lti11InstitutionPrefix):
+		role.Vocabulary = RoleVocabularyInstitution
+		role.Name = strings.TrimPrefix(uri, lti11InstitutionPrefix)
+	case strings.HasPrefix(uri, lti11ContextPrefix):
+		role.Vocabulary = RoleVocabularyContext
+		role.Name, role.SubRole = splitSubRole(strings.TrimPrefix(uri, lti11ContextPrefix), "/")
+	default:
+		name, subRole := splitSubRole(uri, "#")
+		if contextRoleNames[name] {
+			role.Vocabulary = RoleVocabularyContext
+			role.Name, role.SubRole = name, subRole
+		} else {
+			role.Vocabulary = RoleVocabularyUnknown
+			role.Name = uri
+		}
+	}
+	return role
+}
+
+// Is returns true if the role has the given vocabulary and principal name (sub-roles match their principal role)
+func (r Role) Is(vocab RoleVocabulary, name string) bool {
+	return r.Vocabulary == vocab && r.Name == name
+}
+
+func (r Role) String() string {
+	return r.URI
+}
+
+// MarshalJSON writes the role as the uri the platform sent
+func (r Role) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.URI)
+}
+
+// UnmarshalJSON parses a role uri
+func (r *Role) UnmarshalJSON(data []byte) error {
+	var uri string
+	if err := json.Unmarshal(data, &uri); err != nil {
+		return err
+	}
+	*r = ParseRole(uri)
+	return nil
+}
+
+// Roles is a list of parsed roles, as sent in the launch roles claim or for an nrps member
+type Roles []Role
+
+// ParseRoles parses each of the given role uris
+func ParseRoles(uris []string) Roles {
+	roles := make(Roles, len(uris))
+	for i, uri := range uris {
+		roles[i] = ParseRole(uri)
+	}
+	return roles
+}
+
+// Has returns true if any of the roles has the given vocabulary and principal name
+func (r Roles) Has(vocab RoleVocabulary, name string) bool {
+	for _, role := range r {
+		if role.Is(vocab, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasSubRole returns true if any of the roles is the given context sub-role (eg: Instructor, TeachingAssistant)
+func (r Roles) HasSubRole(name, subRole string) bool {
+	for _, role := range r {
+		if role.Is(RoleVocabularyContext, name) && role.SubRole == subRole {
+			return true
+		}
+	}
+	return false
+}
+
+// IsInstructor returns true if the user is an instructor in the launch context (including instructor sub-roles)
+func (r Roles) IsInstructor() bool {
+	return r.Has(RoleVocabularyContext, RoleInstructor)
+}
+
+// IsTeachingAssistant returns true if the user has the Instructor#TeachingAssistant context sub-role
+func (r Roles) IsTeachingAssistant() bool {
+	return r.HasSubRole(RoleInstructor, RoleTeachingAssistant)
+}
+
+// IsLearner returns true if the user is a learner in the launch context
+func (r Roles) IsLearner() bool {
+	return r.Has(RoleVocabularyContext, RoleLearner)
+}
+
+// IsMentor returns true if the user is a mentor in the launch context
+func (r Roles) IsMentor() bool {
+	return r.Has(RoleVocabularyContext, RoleMentor)
+}
+
+// IsContentDeveloper returns true if the user is a content developer in the launch context
+func (r Roles) IsContentDeveloper() bool {
+	return r.Has(RoleVocabularyContext, RoleContentDeveloper)
+}
+
+// IsAdministrator returns true if the user is an administrator of the context, the institution or the system
+func (r Roles) IsAdministrator() bool {
+	return r.Has(RoleVocabularyContext, RoleAdministrator) ||
+		r.Has(RoleVocabularyInstitution, RoleAdministrator) ||
+		r.Has(RoleVocabularySystem, RoleAdministrator) ||
+		r.Has(RoleVocabularySystem, RoleSysAdmin)
+}
+
+func splitSubRole(s, sep string) (string, string) {
+	if idx := strings.Index(s, sep); idx >= 0 {
+		return s[:idx], s[idx+len(sep):]
+	}
+	return s, ""
+}
@@ -0,0 +1,66 @@
+package lti_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/GRT/lti-1-3-go-library/lti"
+)
+
+func TestParseRole(t *testing.T) {
+	tests := []struct {
+		uri     string
+		vocab   lti.RoleVocabulary
+		name    string
+		subRole string
+	}{
+		{"http://purl.imsglobal.org/vocab/lis/v2/membership#Instructor", lti.RoleVocabularyContext, "Instructor", ""},
+		{"http://purl.imsglobal.org/vocab/lis/v2/membership/Instructor#TeachingAssistant", lti.RoleVocabularyContext, "Instructor", "TeachingAssistant"},
+		{"http://purl.imsglobal.org/vocab/lis/v2/institution/person#Student", lti.RoleVocabularyInstitution, "Student", ""},
+		{"http://purl.imsglobal.org/vocab/lis/v2/system/person#SysAdmin", lti.RoleVocabularySystem, "SysAdmin", ""},
+		{"urn:lti:role:ims/lis/Learner", lti.RoleVocabularyContext, "Learner", ""},
+		{"urn:lti:role:ims/lis/Instructor/TeachingAssistant", lti.RoleVocabularyContext, "Instructor", "TeachingAssistant"},
+		{"urn:lti:instrole:ims/lis/Administrator", lti.RoleVocabularyInstitution, "Administrator", ""},
+		{"Learner", lti.RoleVocabularyContext, "Learner", ""},
+		{"Instructor#TeachingAssistant", lti.RoleVocabularyContext, "Instructor", "TeachingAssistant"},
+		{"http://example.com/roles#Wizard", lti.RoleVocabularyUnknown, "http://example.com/roles#Wizard", ""},
+	}
+	for _, tt := range tests {
+		role := lti.ParseRole(tt.uri)
+		if role.Vocabulary != tt.vocab || role.Name != tt.name || role.SubRole != tt.subRole {
+			t.Errorf("ParseRole(%q) = %+v, expected vocab %q, name %q, subRole %q", tt.uri, role, tt.vocab, tt.name, tt.subRole)
+		}
+	}
+}
+
+func TestRolePredicates(t *testing.T) {
+	ta := lti.ParseRoles([]string{"http://purl.imsglobal.org/vocab/lis/v2/membership/Instructor#TeachingAssistant"})
+	if !ta.IsInstructor() || !ta.IsTeachingAssistant() || ta.IsLearner() {
+		t.Fatalf("a teaching assistant should be an instructor sub-role: %+v", ta)
+	}
+	// an institution role alone does not make the user a learner in the context
+	student := lti.ParseRoles([]string{"http://purl.imsglobal.org/vocab/lis/v2/institution/person#Student"})
+	if student.IsLearner() {
+		t.Fatalf("institution Student should not be a context learner")
+	}
+	admin := lti.ParseRoles([]string{"http://purl.imsglobal.org/vocab/lis/v2/system/person#Administrator"})
+	if !admin.IsAdministrator() || admin.IsInstructor() {
+		t.Fatalf("system administrator predicates are wrong: %+v", admin)
+	}
+}
+
+func TestNrpsMemberRoles(t *testing.T) {
+	body := `{"user_id": "u1", "roles": ["http://purl.imsglobal.org/vocab/lis/v2/membership#Mentor", "Learner"]}`
+	var member lti.NrpsMember
+	if err := json.Unmarshal([]byte(body), &member); err != nil {
+		t.Fatalf("failed to parse member: %v", err)
+	}
+	if !member.Roles.IsMentor() || !member.Roles.IsLearner() {
+		t.Fatalf("member roles were not parsed: %+v", member.Roles)
+	}
+	// roles serialize back to the uris the platform sent
+	b, _ := json.Marshal(member.Roles)
+	if string(b) != `["http://purl.imsglobal.org/vocab/lis/v2/membership#Mentor","Learner"]` {
+		t.Fatalf("unexpected roles json: %s", string(b))
+	}
+}
@@ -0,0 +1,234 @@
+package lti
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// RosterChangeType is how a member changed between roster syncs
+type RosterChangeType string
+
+const (
+	// RosterMemberAdded members are new to the context
+	RosterMemberAdded RosterChangeType = "added"
+	// RosterMemberUpdated members changed, eg: their status went from Active to Inactive, or their roles changed
+	RosterMemberUpdated RosterChangeType = "updated"
+	// RosterMemberRemoved members were deleted from, or are no longer in, the context
+	RosterMemberRemoved RosterChangeType = "removed"
+)
+
+// RosterChange is a change RosterSync applied to the local roster
+type RosterChange struct {
+	Type RosterChangeType
+	// ContextKey identifies the context, see RosterSync
+	ContextKey string
+	Member     NrpsMember
+	// Previous is the member as it was in the roster store, nil for added members
+	Previous *NrpsMember
+}
+
+// RosterStore holds local copies of context rosters, and the differences url to sync each one from
+type RosterStore interface {
+	// GetDifferencesURL returns "" if the context hasn't been synced, or the platform gave no differences url
+	GetDifferencesURL(contextKey string) (string, error)
+	SetDifferencesURL(contextKey, differencesURL string) error
+	// GetMember returns nil (and no error) if the member isn't in the roster
+	GetMember(contextKey, userID string) (*NrpsMember, error)
+	PutMember(contextKey string, member NrpsMember) error
+	RemoveMember(contextKey, userID string) error
+	ListMembers(contextKey string) ([]NrpsMember, error)
+}
+
+// RosterSync keeps a RosterStore in step with the platform's rosters.  The first sync of a context fetches the
+// whole roster, later syncs only fetch the differences since the previous one (when the platform supports it).
+// Contexts are identified by their context memberships url, which is unique across platforms.
+type RosterSync struct {
+	store    RosterStore
+	onChange func(RosterChange)
+}
+
+// NewRosterSync creates a RosterSync that applies changes to store and reports each one to onChange (which may be nil)
+func NewRosterSync(store RosterStore, onChange func(RosterChange)) *RosterSync {
+	return &RosterSync{store: store, onChange: onChange}
+}
+
+// Sync brings the local roster of the service's context up to date, returning the changes applied.  If the context is
+// done before the platform's members are fetched, nothing is applied.
+func (r *RosterSync) Sync(ctx context.Context, svc *NameRolesProvisioningService) ([]RosterChange, error) {
+	contextKey := svc.svcData.ContextMembershipsURL
+	differencesURL, err := r.store.GetDifferencesURL(contextKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get the differences url for context: %q", contextKey)
+	}
+	if differencesURL == "" {
+		return r.fullSync(ctx, svc, contextKey)
+	}
+	resp, err := svc.GetMembersSince(ctx, differencesURL)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]RosterChange, 0)
+	for _, member := range resp.Members {
+		change, err := r.applyMember(contextKey, member)
+		if err != nil {
+			return changes, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	// with no new differences url, the next sync is a full one
+	if err := r.store.SetDifferencesURL(contextKey, resp.DifferencesURL); err != nil {
+		return changes, err
+	}
+	return changes, nil
+}
+
+// fullSync applies the whole roster, removing local members that are no longer in it
+func (r *RosterSync) fullSync(ctx context.Context, svc *NameRolesProvisioningService, contextKey string) ([]RosterChange, error) {
+	resp, err := svc.GetMembers(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]RosterChange, 0)
+	inRoster := make(map[string]bool)
+	for _, member := range resp.Members {
+		if member.UserID == "" {
+			continue
+		}
+		inRoster[member.UserID] = true
+		change, err := r.applyMember(contextKey, member)
+		if err != nil {
+			return changes, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	local, err := r.store.ListMembers(contextKey)
+	if err != nil {
+		return changes, err
+	}
+	for _, member := range local {
+		if inRoster[member.UserID] {
+			continue
+		}
+		if err := r.store.RemoveMember(contextKey, member.UserID); err != nil {
+			return changes, err
+		}
+		previous := member
+		changes = append(changes, r.report(RosterChange{Type: RosterMemberRemoved, ContextKey: contextKey, Member: member, Previous: &previous}))
+	}
+	if err := r.store.SetDifferencesURL(contextKey, resp.DifferencesURL); err != nil {
+		return changes, err
+	}
+	return changes, nil
+}
+
+// applyMember adds, updates or removes the member in the store, returning the change (nil if there was none)
+func (r *RosterSync) applyMember(contextKey string, member NrpsMember) (*RosterChange, error) {
+	if member.UserID == "" {
+		return nil, nil
+	}
+	previous, err := r.store.GetMember(contextKey, member.UserID)
+	if err != nil {
+		return nil, err
+	}
+	var change RosterChange
+	switch {
+	case member.Status == NrpsMemberDeleted:
+		if previous == nil {
+			return nil, nil
+		}
+		if err := r.store.RemoveMember(contextKey, member.UserID); err != nil {
+			return nil, err
+		}
+		change = RosterChange{Type: RosterMemberRemoved, ContextKey: contextKey, Member: member, Previous: previous}
+	case previous == nil:
+		if err := r.store.PutMember(contextKey, member); err != nil {
+			return nil, err
+		}
+		change = RosterChange{Type: RosterMemberAdded, ContextKey: contextKey, Member: member}
+	case !reflect.DeepEqual(*previous, member):
+		if err := r.store.PutMember(contextKey, member); err != nil {
+			return nil, err
+		}
+		change = RosterChange{Type: RosterMemberUpdated, ContextKey: contextKey, Member: member, Previous: previous}
+	default:
+		return nil, nil
+	}
+	change = r.report(change)
+	return &change, nil
+}
+
+func (r *RosterSync) report(change RosterChange) RosterChange {
+	if r.onChange != nil {
+		r.onChange(change)
+	}
+	return change
+}
+
+type memoryRosterStore struct {
+	mu              sync.Mutex
+	differencesURLs map[string]string
+	rosters         map[string]map[string]NrpsMember
+}
+
+// NewMemoryRosterStore creates a RosterStore that keeps rosters in memory
+func NewMemoryRosterStore() RosterStore {
+	return &memoryRosterStore{differencesURLs: make(map[string]string), rosters: make(map[string]map[string]NrpsMember)}
+}
+
+func (s *memoryRosterStore) GetDifferencesURL(contextKey string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.differencesURLs[contextKey], nil
+}
+
+func (s *memoryRosterStore) SetDifferencesURL(contextKey, differencesURL string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.differencesURLs[contextKey] = differencesURL
+	return nil
+}
+
+func (s *memoryRosterStore) GetMember(contextKey, userID string) (*NrpsMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if member, exists := s.rosters[contextKey][userID]; exists {
+		return &member, nil
+	}
+	return nil, nil
+}
+
+func (s *memoryRosterStore) PutMember(contextKey string, member NrpsMember) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rosters[contextKey] == nil {
+		s.rosters[contextKey] = make(map[string]NrpsMember)
+	}
+	s.rosters[contextKey][member.UserID] = member
+	return nil
+}
+
+func (s *memoryRosterStore) RemoveMember(contextKey, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rosters[contextKey], userID)
+	return nil
+}
+
+func (s *memoryRosterStore) ListMembers(contextKey string) ([]NrpsMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members := make([]NrpsMember, 0, len(s.rosters[contextKey]))
+	for _, member := range s.rosters[contextKey] {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].UserID < members[j].UserID })
+	return members, nil
+}
@@ -0,0 +1,82 @@
+package lti_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GRT/lti-1-3-go-library/lti"
+)
+
+func TestRosterSync(t *testing.T) {
+	var platform *httptest.Server
+	platform, conn := newTestPlatform(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Query().Get("since") {
+		case "":
+			w.Header().Add("Link", fmt.Sprintf(`<%s/members?since=1>; rel="differences"`, platform.URL))
+			fmt.Fprint(w, `{"id": "m1", "context": {"id": "ctx1"}, "members": [
+				{"user_id": "u1", "name": "One", "roles": ["Learner"]},
+				{"user_id": "u2", "name": "Two", "roles": ["Learner"]},
+				{"user_id": "u3", "name": "Three", "roles": ["Instructor"]}]}`)
+		case "1":
+			w.Header().Add("Link", fmt.Sprintf(`<%s/members?since=2>; rel="differences"`, platform.URL))
+			fmt.Fprint(w, `{"id": "m2", "context": {"id": "ctx1"}, "members": [
+				{"user_id": "u2", "name": "Two", "roles": ["Learner"], "status": "Inactive"},
+				{"user_id": "u3", "status": "Deleted"},
+				{"user_id": "u4", "name": "Four", "roles": ["Learner"]}]}`)
+		default:
+			http.NotFound(w, req)
+		}
+	})
+	defer platform.Close()
+
+	svc := lti.NewNameRolesProvisioningService(conn, &lti.NrpsServiceClaim{ContextMembershipsURL: platform.URL + "/members"})
+	store := lti.NewMemoryRosterStore()
+	reported := make([]lti.RosterChange, 0)
+	rosterSync := lti.NewRosterSync(store, func(change lti.RosterChange) { reported = append(reported, change) })
+
+	// a sync whose context is done applies nothing
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := rosterSync.Sync(cancelled, svc); err != context.Canceled || len(reported) != 0 {
+		t.Fatalf("expected the cancelled sync to fail without changes, got: %v, %d changes", err, len(reported))
+	}
+
+	changes, err := rosterSync.Sync(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("first sync failed: %v", err)
+	}
+	if len(changes) != 3 || changes[0].Type != lti.RosterMemberAdded {
+		t.Fatalf("expected 3 members added by the full sync, got: %+v", changes)
+	}
+
+	changes, err = rosterSync.Sync(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("differences sync failed: %v", err)
+	}
+	byUser := make(map[string]lti.RosterChange)
+	for _, change := range changes {
+		byUser[change.Member.UserID] = change
+	}
+	if c := byUser["u2"]; c.Type != lti.RosterMemberUpdated || c.Member.IsActive() || c.Previous == nil || !c.Previous.IsActive() {
+		t.Fatalf("expected u2 to become inactive, got: %+v", c)
+	}
+	if c := byUser["u3"]; c.Type != lti.RosterMemberRemoved || c.Previous == nil || c.Previous.Name != "Three" {
+		t.Fatalf("expected u3 to be removed, got: %+v", c)
+	}
+	if c := byUser["u4"]; c.Type != lti.RosterMemberAdded {
+		t.Fatalf("expected u4 to be added, got: %+v", c)
+	}
+	if len(reported) != 6 {
+		t.Fatalf("every change should be reported to the callback, got %d", len(reported))
+	}
+	members, _ := store.ListMembers(platform.URL + "/members")
+	if len(members) != 3 || members[0].UserID != "u1" || members[2].UserID != "u4" {
+		t.Fatalf("unexpected local roster: %+v", members)
+	}
+	if url, _ := store.GetDifferencesURL(platform.URL + "/members"); url != platform.URL+"/members?since=2" {
+		t.Fatalf("the latest differences url should be stored, got: %q", url)
+	}
+}
@@ -1,8 +1,10 @@
 package lti
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -13,49 +15,92 @@ import (
 
 	"github.com/pkg/errors"
 
-	jwt "github.com/dgrijalva/jwt-go"
+	jwt "github.com/golang-jwt/jwt/v4"
 	"github.com/segmentio/ksuid"
 
 	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
 )
 
+const defaultClientAssertionLifetime = time.Minute
+
+// defaultServiceClient is the http client of ServiceConnectors that weren't given one
+var defaultServiceClient = &http.Client{Timeout: time.Second * 30}
+
 // ServiceConnector helper util that can hit endpoints associated with an lti1.3 launch
 type ServiceConnector struct {
 	registration registrationDatastore.Registration
-	tokenMap     map[string]string
+	tokens       *AccessTokenCache
+	client       *http.Client
+	retry        ServiceRetryPolicy
+}
+
+// ServiceRequest is a request to a platform service endpoint
+type ServiceRequest struct {
+	// Method defaults to GET
+	Method string
+	URL    string
+	// Scopes are the scopes of the access token the request is made with
+	Scopes []string
+	// Body is sent for any method that has one (POST, PUT, PATCH and, if not empty, DELETE)
+	Body string
+	// ContentType and Accept default to application/json
+	ContentType string
+	Accept      string
+	// Header holds any additional request headers
+	Header http.Header
+	// Idempotent allows retrying a POST or PATCH, for requests the platform is known to handle idempotently.
+	// Other POSTs and PATCHes are only retried when they weren't sent (see ServiceError.NotSent).
+	Idempotent bool
 }
 
-// NewServiceConnector creates a new ServiceConnector
+// NewServiceConnector creates a new ServiceConnector, sharing access tokens through DefaultAccessTokenCache
 func NewServiceConnector(reg registrationDatastore.Registration) *ServiceConnector {
-	return &ServiceConnector{registration: reg, tokenMap: make(map[string]string)}
+	return NewServiceConnectorWithTokenCache(reg, DefaultAccessTokenCache)
 }
 
-func (s *ServiceConnector) getAccessToken(scopes []string) (string, error) {
+// NewServiceConnectorWithTokenCache creates a new ServiceConnector that keeps its access tokens in the given cache
+func NewServiceConnectorWithTokenCache(reg registrationDatastore.Registration, tokens *AccessTokenCache) *ServiceConnector {
+	return &ServiceConnector{registration: reg, tokens: tokens, client: defaultServiceClient, retry: DefaultServiceRetryPolicy}
+}
+
+// WithHTTPClient returns a copy of the connector that makes its requests (including token fetches) with the given client
+func (s *ServiceConnector) WithHTTPClient(client *http.Client) *ServiceConnector {
+	conn := *s
+	conn.client = client
+	return &conn
+}
+
+// WithRetryPolicy returns a copy of the connector that retries requests according to the policy
+func (s *ServiceConnector) WithRetryPolicy(policy ServiceRetryPolicy) *ServiceConnector {
+	conn := *s
+	conn.retry = policy
+	return &conn
+}
+
+// WithTransport returns a copy of the connector that makes its requests through the given RoundTripper, eg: to stub
+// the platform in tests, or to add instrumentation
+func (s *ServiceConnector) WithTransport(transport http.RoundTripper) *ServiceConnector {
+	return s.WithHTTPClient(&http.Client{Timeout: defaultServiceClient.Timeout, Transport: transport})
+}
+
+func (s *ServiceConnector) getAccessToken(ctx context.Context, scopes []string) (string, error) {
+	return s.tokens.Get(ctx, accessTokenKey(s.registration, scopes), func(fetchCtx context.Context) (string, time.Duration, error) {
+		return s.fetchAccessToken(fetchCtx, scopes)
+	})
+}
+
+// fetchAccessToken requests a new access token from the platform, returning it with its lifetime
+func (s *ServiceConnector) fetchAccessToken(ctx context.Context, scopes []string) (string, time.Duration, error) {
+	scopes = append([]string(nil), scopes...)
 	sort.Strings(scopes)
 	scopeStr := strings.Join(scopes, " ")
-	if cachedToken, exists := s.tokenMap[scopeStr]; exists {
-		return cachedToken, nil
-	}
 
-	privkey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(s.registration.ToolPrivateKey))
-	if err != nil {
-		return "", errors.Wrapf(err, "GetAccessToken: Error getting Tool Private Key for clientId: %q.", s.registration.ClientID)
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-		"iss": toolIssuer,
-		"sub": s.registration.ClientID,
-		"aud": s.registration.AuthTokenURL,
-		"iat": time.Now().Unix(),
-		"exp": time.Now().Unix() + 60,
-		"jti": fmt.Sprintf("lti-service-token-%s", ksuid.New().String()),
-	})
-	tokenStr, err := token.SignedString(privkey)
+	tokenStr, err := signWithToolKey(s.registration, clientAssertionClaims(s.registration, time.Now()))
 	if err != nil {
-		return "", errors.Wrapf(err, "GetAccessToken: Error signing token for clientId: %q.", s.registration.ClientID)
+		return "", 0, errors.Wrap(err, "GetAccessToken: Error creating the client assertion")
 	}
 	// log.Printf("jwt generated: %s", tokenStr)
 
-	client := &http.Client{Timeout: time.Second * 30}
 	form := url.Values{}
 	form.Add("grant_type", "client_credentials")
 	form.Add("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
@@ -64,81 +109,160 @@ func (s *ServiceConnector) getAccessToken(scopes []string) (string, error) {
 	log.Printf("Access Token Fetch Url: %s", s.registration.AuthTokenURL)
 	// log.Printf("                  Form: %+v", form)
 
-	req, err := http.NewRequest("POST", s.registration.AuthTokenURL, strings.NewReader(form.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", s.registration.AuthTokenURL, strings.NewReader(form.Encode()))
 	// req, err := http.NewRequest("POST", "http://localhost:11112/goFromLocalhost", strings.NewReader(form.Encode()))
 	if err != nil {
-		return "", errors.Wrapf(err, "GetAccessToken: Error generating the token request url for clientId: %q.", s.registration.ClientID)
+		return "", 0, errors.Wrapf(err, "GetAccessToken: Error generating the token request url for clientId: %q.", s.registration.ClientID)
 	}
-	response, err := client.Do(req)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := s.client.Do(req)
 	if err != nil {
-		return "", errors.Wrapf(err, "GetAccessToken: Error executing the form POST for clientId: %q.", s.registration.ClientID)
+		return "", 0, errors.Wrapf(newTransportError("POST", s.registration.AuthTokenURL, err), "GetAccessToken: Error executing the form POST for clientId: %q.", s.registration.ClientID)
 	}
 	log.Printf("Access token response status: %s", response.Status)
-	if response.StatusCode < 200 || response.StatusCode >= 300 {
-		// log.Printf("bad response code, response: %+v", response)
-		return "", fmt.Errorf("getAccessToken: Error response from access token fetch (%q)", response.Status)
-	}
 
 	defer response.Body.Close()
 	// log.Printf("returned headers: %v", response.Header)
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return "", errors.Wrapf(err, "GetAccessToken: Error reading body of access token fetch response for clientId: %q.", s.registration.ClientID)
+		return "", 0, errors.Wrapf(newTransportError("POST", s.registration.AuthTokenURL, err), "GetAccessToken: Error reading body of access token fetch response for clientId: %q.", s.registration.ClientID)
 	}
 	// log.Printf("response Body: %q", string(body))
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return "", 0, errors.Wrapf(newServiceError("POST", s.registration.AuthTokenURL, response.StatusCode, response.Header, string(body)), "GetAccessToken: Error response from access token fetch for clientId: %q", s.registration.ClientID)
+	}
 
-	var data map[string]interface{}
+	var data struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
 	if err := json.Unmarshal(body, &data); err != nil {
-		return "", errors.Wrapf(err, "GetAccessToken: Failed to parse json from body of access token fetch response for clientId: %q.", s.registration.ClientID)
+		return "", 0, errors.Wrapf(err, "GetAccessToken: Failed to parse json from body of access token fetch response for clientId: %q.", s.registration.ClientID)
+	}
+	if data.AccessToken == "" {
+		// some platforms answer OAuth errors with a 200
+		svcErr := newServiceError("POST", s.registration.AuthTokenURL, response.StatusCode, response.Header, string(body))
+		return "", 0, errors.Wrapf(svcErr, "GetAccessToken: No access_token in the token response for clientId: %q", s.registration.ClientID)
 	}
-	accessToken := data["access_token"].(string)
-	// log.Printf("access token retrieved: %s", access_token)
-	s.tokenMap[scopeStr] = accessToken
-	return accessToken, nil
+	return data.AccessToken, time.Duration(data.ExpiresIn) * time.Second, nil
 }
 
-// DoServiceRequest fetches an auth token for a service call, then makes and returns the results of that call
-func (s *ServiceConnector) DoServiceRequest(scopes []string, url, pMethod, body, pContentType, pAccept string) (*ServiceResult, error) {
-	var (
-		method      = "GET"
-		contentType = "application/json"
-		accept      = "application/json"
-		req         *http.Request
-	)
-	if pMethod != "" {
-		method = pMethod
+// clientAssertionClaims are the claims of the jwt the tool authenticates with when fetching a service token
+// (the LTI security framework's client credentials grant): the tool is both issuer and subject, as its client_id
+func clientAssertionClaims(reg registrationDatastore.Registration, now time.Time) jwt.MapClaims {
+	aud := reg.AuthTokenAudience
+	if aud == "" {
+		aud = reg.AuthTokenURL
 	}
-	if pContentType != "" {
-		contentType = pContentType
+	lifetime := defaultClientAssertionLifetime
+	if reg.ClientAssertionLifetime > 0 {
+		lifetime = time.Duration(reg.ClientAssertionLifetime) * time.Second
 	}
-	if pAccept != "" {
-		accept = pAccept
+	return jwt.MapClaims{
+		"iss": reg.ClientID,
+		"sub": reg.ClientID,
+		"aud": aud,
+		"iat": now.Unix(),
+		"exp": now.Add(lifetime).Unix(),
+		"jti": fmt.Sprintf("lti-service-token-%s", ksuid.New().String()),
 	}
-	accessToken, err := s.getAccessToken(scopes)
-	if err != nil {
-		return nil, err
+}
+
+// DoServiceRequest fetches an auth token for a service call, then makes and returns the results of that call.
+// Unsuccessful (non 2xx) responses, and failures fetching the token, are returned as a *ServiceError.
+func (s *ServiceConnector) DoServiceRequest(scopes []string, url, method, body, contentType, accept string) (*ServiceResult, error) {
+	return s.Do(context.Background(), ServiceRequest{Method: method, URL: url, Scopes: scopes, Body: body, ContentType: contentType, Accept: accept})
+}
+
+// Do fetches an auth token for the request's scopes, then makes the request and returns its results.
+// Unsuccessful (non 2xx) responses, and failures fetching the token, are returned as a *ServiceError.
+// Idempotent requests that fail with a Retryable error are retried according to the connector's ServiceRetryPolicy,
+// as are other requests that never reached the platform (eg: the connection or access token fetch failed).  Any request
+// the platform answers with a 401 is retried once with a new access token.
+func (s *ServiceConnector) Do(ctx context.Context, svcReq ServiceRequest) (*ServiceResult, error) {
+	if svcReq.Method == "" {
+		svcReq.Method = "GET"
 	}
-	// log.Printf("access token fetched: %s", accessToken)
-	client := &http.Client{Timeout: time.Second * 30}
-	if method == "POST" {
-		req, err = http.NewRequest(method, url, strings.NewReader(body))
-		if err != nil {
-			return nil, errors.Wrapf(err, "DoServiceReq: Error Creating new request for POST to %q", url)
+	svcReq.Method = strings.ToUpper(svcReq.Method)
+	if svcReq.ContentType == "" {
+		svcReq.ContentType = "application/json"
+	}
+	if svcReq.Accept == "" {
+		svcReq.Accept = "application/json"
+	}
+	canRetry := svcReq.Idempotent || isIdempotentMethod(svcReq.Method)
+	refreshedToken := false
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		accessToken, err := s.getAccessToken(ctx, svcReq.Scopes)
+		var res *ServiceResult
+		if err == nil {
+			res, err = s.doOnce(ctx, svcReq, accessToken)
+		}
+		if err == nil {
+			return res, nil
+		}
+		var svcErr *ServiceError
+		if !errors.As(err, &svcErr) || ctx.Err() != nil {
+			return nil, err
 		}
-		req.Header.Add("Content-Type", contentType)
-	} else { // GET
-		req, err = http.NewRequest(method, url, nil)
-		if err != nil {
-			return nil, errors.Wrapf(err, "DoServiceReq: Error Creating new request for method: %q to %q", method, url)
+		if svcErr.StatusCode == http.StatusUnauthorized && svcErr.URL == svcReq.URL && !refreshedToken {
+			// the platform may have revoked the token before it expired
+			refreshedToken = true
+			s.tokens.Invalidate(accessTokenKey(s.registration, svcReq.Scopes), accessToken)
+			s.retry.notify(ServiceRetry{Method: svcReq.Method, URL: svcReq.URL, Attempt: attempt, Err: svcErr, TokenRefresh: true})
+			continue
+		}
+		// a failed token fetch (a ServiceError for the token url) means the request wasn't sent
+		sent := svcErr.URL == svcReq.URL && !svcErr.NotSent
+		if (sent && !canRetry) || !svcErr.Retryable || attempt >= s.retry.MaxAttempts {
+			return nil, err
+		}
+		delay, ok := s.retry.delay(attempt, svcErr)
+		if !ok {
+			return nil, err
+		}
+		log.Printf("Retrying %s to %q in %v after attempt %d failed: %v", svcReq.Method, svcReq.URL, delay, attempt, err)
+		s.retry.notify(ServiceRetry{Method: svcReq.Method, URL: svcReq.URL, Attempt: attempt, Delay: delay, Err: svcErr})
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
 		}
 	}
+}
 
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
-	req.Header.Add("Accept", accept)
-	log.Printf("About to make request for url, request: %+v", req)
-	resp, err := client.Do(req)
+// doOnce makes a single attempt at the request, whose method, content type and accept have been defaulted
+func (s *ServiceConnector) doOnce(ctx context.Context, svcReq ServiceRequest, accessToken string) (*ServiceResult, error) {
+	method, url := svcReq.Method, svcReq.URL
+	// log.Printf("access token fetched: %s", accessToken)
+	var body io.Reader
+	hasBody := method == "POST" || method == "PUT" || method == "PATCH" || (method == "DELETE" && svcReq.Body != "")
+	if hasBody {
+		body = strings.NewReader(svcReq.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
-		return nil, errors.Wrapf(err, "DoServiceReq: Error Executing new request for method: %q to %q", method, url)
+		return nil, errors.Wrapf(err, "DoServiceReq: Error Creating new request for method: %q to %q", method, url)
+	}
+	for key, values := range svcReq.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if hasBody {
+		req.Header.Set("Content-Type", svcReq.ContentType)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	req.Header.Set("Accept", svcReq.Accept)
+	log.Printf("About to make %s request for url: %q", method, url)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(newTransportError(method, url, err), "DoServiceReq: Error Executing new request")
 	}
 
 	log.Printf("Response received for method: %q to %q: %q", method, url, resp.Status)
@@ -146,8 +270,11 @@ func (s *ServiceConnector) DoServiceRequest(scopes []string, url, pMethod, body,
 	defer resp.Body.Close()
 	bodyBytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, errors.Wrapf(err, "DoServiceReq: Error reading the response body for method: %q to %q", method, url)
+		return nil, errors.Wrap(newTransportError(method, url, err), "DoServiceReq: Error reading the response body")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, newServiceError(method, url, resp.StatusCode, resp.Header, string(bodyBytes))
 	}
 
-	return &ServiceResult{Header: resp.Header, Body: string(bodyBytes)}, nil
+	return &ServiceResult{StatusCode: resp.StatusCode, Header: resp.Header, Body: string(bodyBytes)}, nil
 }
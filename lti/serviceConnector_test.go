@@ -0,0 +1,296 @@
+package lti_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GRT/lti-1-3-go-library/lti"
+	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// fetchClientAssertion makes a service request with the registration and returns the client assertion the platform received
+func fetchClientAssertion(t *testing.T, reg registrationDatastore.Registration) (string, string) {
+	var assertion, assertionType string
+	platform := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			assertion = req.FormValue("client_assertion")
+			assertionType = req.FormValue("client_assertion_type")
+			fmt.Fprint(w, `{"access_token": "test-token", "expires_in": 3600}`)
+			return
+		}
+		fmt.Fprint(w, `{"id": "m1", "context": {"id": "ctx1"}, "members": []}`)
+	}))
+	defer platform.Close()
+	reg.AuthTokenURL = platform.URL + "/token"
+	conn := lti.NewServiceConnectorWithTokenCache(reg, lti.NewAccessTokenCache(time.Minute))
+	svc := lti.NewNameRolesProvisioningService(conn, &lti.NrpsServiceClaim{ContextMembershipsURL: platform.URL + "/members"})
+	if _, err := svc.GetMembers(context.Background(), nil); err != nil {
+		t.Fatalf("GetMembers failed: %v", err)
+	}
+	if assertionType != "urn:ietf:params:oauth:client-assertion-type:jwt-bearer" {
+		t.Fatalf("unexpected client_assertion_type: %q", assertionType)
+	}
+	return assertion, reg.AuthTokenURL
+}
+
+func TestClientAssertion(t *testing.T) {
+	reg := getTestRegistration(t)
+	publishedKid, _ := reg.GetToolKeys()[0].ID()
+	privkey, _ := reg.GetToolKeys()[0].RSAPrivateKey()
+
+	tokenStr, tokenURL := fetchClientAssertion(t, *reg)
+	token, err := jwt.Parse(tokenStr, func(tok *jwt.Token) (interface{}, error) { return &privkey.PublicKey, nil })
+	if err != nil {
+		t.Fatalf("client assertion did not verify with the tool key: %v", err)
+	}
+	if token.Header["kid"] != publishedKid {
+		t.Fatalf("expected kid %q, got %v", publishedKid, token.Header["kid"])
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["iss"] != reg.ClientID || claims["sub"] != reg.ClientID {
+		t.Fatalf("iss and sub should both be the client_id, got: %v, %v", claims["iss"], claims["sub"])
+	}
+	if claims["aud"] != tokenURL {
+		t.Fatalf("aud should default to the token url, got: %v", claims["aud"])
+	}
+	if claims["jti"] == "" || int64(claims["exp"].(float64))-int64(claims["iat"].(float64)) != 60 {
+		t.Fatalf("unexpected jti or lifetime: %v", claims)
+	}
+
+	// platforms may want a different audience, and a longer lifetime
+	reg.AuthTokenAudience = "https://platform.example.com/oauth2/token"
+	reg.ClientAssertionLifetime = 300
+	tokenStr, _ = fetchClientAssertion(t, *reg)
+	claims = jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(tokenStr, claims, func(tok *jwt.Token) (interface{}, error) { return &privkey.PublicKey, nil }); err != nil {
+		t.Fatalf("client assertion did not verify with the tool key: %v", err)
+	}
+	if claims["aud"] != reg.AuthTokenAudience {
+		t.Fatalf("expected the configured audience, got: %v", claims["aud"])
+	}
+	if int64(claims["exp"].(float64))-int64(claims["iat"].(float64)) != 300 {
+		t.Fatalf("expected the configured lifetime, got: %v", claims)
+	}
+}
+
+func TestServiceErrors(t *testing.T) {
+	platform, conn := newTestPlatform(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/forbidden":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(403)
+			fmt.Fprint(w, `{"error": "invalid_scope", "error_description": "lineitem scope not granted"}`)
+		case "/down":
+			http.Error(w, "maintenance", 503)
+		default:
+			fmt.Fprint(w, `{"id": "m1", "context": {"id": "ctx1"}, "members": []}`)
+		}
+	})
+	defer platform.Close()
+	conn = conn.WithRetryPolicy(lti.ServiceRetryPolicy{})
+
+	svc := lti.NewNameRolesProvisioningService(conn, &lti.NrpsServiceClaim{ContextMembershipsURL: platform.URL + "/forbidden"})
+	_, err := svc.GetMembers(context.Background(), nil)
+	var svcErr *lti.ServiceError
+	if !errors.As(err, &svcErr) {
+		t.Fatalf("expected a ServiceError, got: %v", err)
+	}
+	if svcErr.StatusCode != 403 || svcErr.OAuthError != lti.OAuthInvalidScope || svcErr.OAuthErrorDescription != "lineitem scope not granted" ||
+		!svcErr.IsMissingScope() || svcErr.Retryable || svcErr.URL != platform.URL+"/forbidden" {
+		t.Fatalf("unexpected service error: %+v", svcErr)
+	}
+
+	svc = lti.NewNameRolesProvisioningService(conn, &lti.NrpsServiceClaim{ContextMembershipsURL: platform.URL + "/down"})
+	if _, err = svc.GetMembers(context.Background(), nil); !errors.As(err, &svcErr) || svcErr.StatusCode != 503 || !svcErr.Retryable || svcErr.IsMissingScope() {
+		t.Fatalf("expected a retryable ServiceError, got: %v", err)
+	}
+
+	// token fetch failures are ServiceErrors too
+	tokenPlatform := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		fmt.Fprint(w, `{"error": "invalid_client", "error_description": "unknown kid"}`)
+	}))
+	defer tokenPlatform.Close()
+	reg := getTestRegistration(t)
+	reg.AuthTokenURL = tokenPlatform.URL + "/token"
+	svc = lti.NewNameRolesProvisioningService(lti.NewServiceConnectorWithTokenCache(*reg, lti.NewAccessTokenCache(time.Minute)).WithRetryPolicy(lti.ServiceRetryPolicy{}),
+		&lti.NrpsServiceClaim{ContextMembershipsURL: tokenPlatform.URL + "/members"})
+	if _, err = svc.GetMembers(context.Background(), nil); !errors.As(err, &svcErr) || svcErr.OAuthError != lti.OAuthInvalidClient || svcErr.URL != reg.AuthTokenURL || svcErr.Retryable {
+		t.Fatalf("expected an invalid_client ServiceError from the token fetch, got: %v", err)
+	}
+
+	// unreachable platforms are retryable
+	tokenPlatform.Close()
+	if _, err = svc.GetMembers(context.Background(), nil); !errors.As(err, &svcErr) || svcErr.StatusCode != 0 || !svcErr.Retryable {
+		t.Fatalf("expected a retryable ServiceError for an unreachable platform, got: %v", err)
+	}
+}
+
+// roundTripFunc stubs the platform without a server
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func stubResponse(status int, body string, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{StatusCode: status, Status: http.StatusText(status), Header: header, Body: ioutil.NopCloser(strings.NewReader(body))}
+}
+
+func TestServiceConnectorDo(t *testing.T) {
+	reg := getTestRegistration(t)
+	reg.AuthTokenURL = "https://platform.example.com/token"
+	var requests []*http.Request
+	var bodies []string
+	conn := lti.NewServiceConnectorWithTokenCache(*reg, lti.NewAccessTokenCache(time.Minute)).WithTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/token" {
+			return stubResponse(200, `{"access_token": "stub-token", "expires_in": 3600}`, nil), nil
+		}
+		body := ""
+		if req.Body != nil {
+			b, _ := ioutil.ReadAll(req.Body)
+			body = string(b)
+		}
+		requests, bodies = append(requests, req), append(bodies, body)
+		return stubResponse(200, `{"ok": true}`, http.Header{"Etag": []string{`"v2"`}}), nil
+	}))
+
+	for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+		res, err := conn.Do(context.Background(), lti.ServiceRequest{
+			Method: method, URL: "https://platform.example.com/lineitems/1", Scopes: []string{"scope"},
+			Body: `{"label": "x"}`, ContentType: "application/vnd.ims.lis.v2.lineitem+json", Header: http.Header{"If-Match": []string{`"v1"`}},
+		})
+		if err != nil {
+			t.Fatalf("%s failed: %v", method, err)
+		}
+		if res.StatusCode != 200 || res.Header.Get("ETag") != `"v2"` {
+			t.Fatalf("expected the response status and headers, got: %+v", res)
+		}
+		req, body := requests[len(requests)-1], bodies[len(bodies)-1]
+		if req.Method != method || body != `{"label": "x"}` || req.Header.Get("Content-Type") != "application/vnd.ims.lis.v2.lineitem+json" ||
+			req.Header.Get("If-Match") != `"v1"` || req.Header.Get("Authorization") != "Bearer stub-token" {
+			t.Fatalf("unexpected %s request: %+v, body: %q", method, req, body)
+		}
+	}
+
+	// GETs have no body
+	if _, err := conn.Do(context.Background(), lti.ServiceRequest{URL: "https://platform.example.com/lineitems", Scopes: []string{"scope"}, Body: "ignored"}); err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	if req := requests[len(requests)-1]; req.Method != "GET" || bodies[len(bodies)-1] != "" || req.Header.Get("Content-Type") != "" {
+		t.Fatalf("unexpected GET request: %+v", req)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := conn.Do(ctx, lti.ServiceRequest{URL: "https://platform.example.com/lineitems", Scopes: []string{"scope"}}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancelled context to stop the request, got: %v", err)
+	}
+}
+
+func TestServiceConnectorRetries(t *testing.T) {
+	reg := getTestRegistration(t)
+	reg.AuthTokenURL = "https://platform.example.com/token"
+	tokenFetches, calls := 0, 0
+	responses := []*http.Response{}
+	conn := lti.NewServiceConnectorWithTokenCache(*reg, lti.NewAccessTokenCache(time.Minute)).WithTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/token" {
+			tokenFetches++
+			return stubResponse(200, fmt.Sprintf(`{"access_token": "token-%d", "expires_in": 3600}`, tokenFetches), nil), nil
+		}
+		calls++
+		res := responses[0]
+		responses = responses[1:]
+		return res, nil
+	}))
+	var retries []lti.ServiceRetry
+	conn = conn.WithRetryPolicy(lti.ServiceRetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond, MaxRetryAfter: time.Second,
+		OnRetry: func(retry lti.ServiceRetry) { retries = append(retries, retry) }})
+	get := lti.ServiceRequest{URL: "https://platform.example.com/members", Scopes: []string{"scope"}}
+
+	// throttling and outages are retried, honouring Retry-After
+	responses = []*http.Response{
+		stubResponse(429, "slow down", http.Header{"Retry-After": []string{"0"}}),
+		stubResponse(503, "unavailable", nil),
+		stubResponse(200, "{}", nil),
+	}
+	if _, err := conn.Do(context.Background(), get); err != nil {
+		t.Fatalf("expected the request to succeed after retrying, got: %v", err)
+	}
+	if calls != 3 || len(retries) != 2 || retries[0].Delay != 0 || retries[0].Err.StatusCode != 429 || retries[1].Attempt != 2 {
+		t.Fatalf("unexpected retries, calls: %d, retries: %+v", calls, retries)
+	}
+
+	// attempts are limited
+	calls, retries = 0, nil
+	responses = []*http.Response{stubResponse(502, "", nil), stubResponse(502, "", nil), stubResponse(502, "", nil)}
+	var svcErr *lti.ServiceError
+	if _, err := conn.Do(context.Background(), get); !errors.As(err, &svcErr) || svcErr.StatusCode != 502 || calls != 3 {
+		t.Fatalf("expected the request to fail after 3 attempts, got: %v after %d calls", err, calls)
+	}
+
+	// POSTs aren't retried unless they're idempotent
+	calls = 0
+	responses = []*http.Response{stubResponse(503, "", nil)}
+	if _, err := conn.Do(context.Background(), lti.ServiceRequest{Method: "POST", URL: get.URL, Scopes: get.Scopes}); err == nil || calls != 1 {
+		t.Fatalf("expected the POST to fail without a retry, got: %v after %d calls", err, calls)
+	}
+	calls = 0
+	responses = []*http.Response{stubResponse(503, "", nil), stubResponse(200, "{}", nil)}
+	if _, err := conn.Do(context.Background(), lti.ServiceRequest{Method: "POST", URL: get.URL, Scopes: get.Scopes, Idempotent: true}); err != nil || calls != 2 {
+		t.Fatalf("expected the idempotent POST to be retried, got: %v after %d calls", err, calls)
+	}
+
+	// but any request is retried if it wasn't sent
+	calls = 0
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	conn2 := conn.WithTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/token" {
+			return stubResponse(200, `{"access_token": "token", "expires_in": 3600}`, nil), nil
+		}
+		calls++
+		if calls == 1 {
+			return nil, refused
+		}
+		return stubResponse(200, "{}", nil), nil
+	}))
+	if _, err := conn2.Do(context.Background(), lti.ServiceRequest{Method: "POST", URL: get.URL, Scopes: []string{"other"}}); err != nil || calls != 2 {
+		t.Fatalf("expected the unsent POST to be retried, got: %v after %d calls", err, calls)
+	}
+
+	// waits longer than MaxRetryAfter fail straight away
+	calls = 0
+	responses = []*http.Response{stubResponse(503, "", http.Header{"Retry-After": []string{"3600"}})}
+	if _, err := conn.Do(context.Background(), get); err == nil || calls != 1 {
+		t.Fatalf("expected a long Retry-After to fail the request, got: %v after %d calls", err, calls)
+	}
+
+	// a rejected token is refreshed once, whatever the method
+	calls, retries = 0, nil
+	responses = []*http.Response{stubResponse(401, "", nil), stubResponse(200, "{}", nil)}
+	if _, err := conn.Do(context.Background(), lti.ServiceRequest{Method: "POST", URL: get.URL, Scopes: get.Scopes}); err != nil {
+		t.Fatalf("expected the request to succeed with a new token, got: %v", err)
+	}
+	if tokenFetches != 2 || calls != 2 || len(retries) != 1 || !retries[0].TokenRefresh {
+		t.Fatalf("expected one token refresh, token fetches: %d, calls: %d, retries: %+v", tokenFetches, calls, retries)
+	}
+	calls = 0
+	responses = []*http.Response{stubResponse(401, "", nil), stubResponse(401, "", nil)}
+	if _, err := conn.Do(context.Background(), get); !errors.As(err, &svcErr) || svcErr.StatusCode != 401 || calls != 2 {
+		t.Fatalf("expected the token to be refreshed only once, got: %v after %d calls", err, calls)
+	}
+}
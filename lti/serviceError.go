@@ -0,0 +1,98 @@
+package lti
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// OAuth error codes platforms answer token requests with (RFC 6749 section 5.2)
+const (
+	OAuthInvalidRequest       = "invalid_request"
+	OAuthInvalidClient        = "invalid_client"
+	OAuthInvalidGrant         = "invalid_grant"
+	OAuthUnauthorizedClient   = "unauthorized_client"
+	OAuthUnsupportedGrantType = "unsupported_grant_type"
+	OAuthInvalidScope         = "invalid_scope"
+)
+
+// ServiceError is returned (possibly wrapped, use errors.As) when a platform service call or service token fetch fails.
+// StatusCode is 0 when no response was received, eg: the platform couldn't be reached.
+type ServiceError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Header     http.Header
+	Body       string
+	// OAuthError and OAuthErrorDescription are the error and error_description of an OAuth error response, if the body was one
+	OAuthError            string
+	OAuthErrorDescription string
+	// Retryable is true when the same request may succeed later: no response, timeouts, throttling and 5xx responses
+	Retryable bool
+	// NotSent is true when the request never reached the platform (the connection couldn't be made), so it can be
+	// retried even if it isn't idempotent
+	NotSent bool
+	// Err is the underlying error when no response was received
+	Err error
+}
+
+func (e *ServiceError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s %q failed: %v", e.Method, e.URL, e.Err)
+	}
+	msg := fmt.Sprintf("%s %q failed with status %d", e.Method, e.URL, e.StatusCode)
+	if e.OAuthError != "" {
+		msg = fmt.Sprintf("%s: %s", msg, e.OAuthError)
+		if e.OAuthErrorDescription != "" {
+			msg = fmt.Sprintf("%s (%s)", msg, e.OAuthErrorDescription)
+		}
+	} else if body := strings.TrimSpace(e.Body); body != "" {
+		msg = fmt.Sprintf("%s: %s", msg, body)
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error, if there was one
+func (e *ServiceError) Unwrap() error {
+	return e.Err
+}
+
+// IsMissingScope is true when the platform refused the call or token because the tool lacks the scope for it
+func (e *ServiceError) IsMissingScope() bool {
+	return e.OAuthError == OAuthInvalidScope || e.StatusCode == http.StatusForbidden
+}
+
+// newServiceError creates the ServiceError for an unsuccessful response, parsing the body if it is an OAuth error
+func newServiceError(method, url string, statusCode int, header http.Header, body string) *ServiceError {
+	svcErr := &ServiceError{Method: method, URL: url, StatusCode: statusCode, Header: header, Body: body, Retryable: isRetryableStatus(statusCode)}
+	var oauthErr struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if json.Unmarshal([]byte(body), &oauthErr) == nil {
+		svcErr.OAuthError, svcErr.OAuthErrorDescription = oauthErr.Error, oauthErr.ErrorDescription
+	}
+	return svcErr
+}
+
+// newTransportError creates the ServiceError for a request that got no response
+func newTransportError(method, url string, err error) *ServiceError {
+	return &ServiceError{Method: method, URL: url, Retryable: true, NotSent: isDialError(err), Err: err}
+}
+
+// isDialError is true when the connection to the platform couldn't be made, so no request was sent
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
@@ -1,9 +1,28 @@
 package lti
 
-import "net/http"
+import (
+	"net/http"
+	"regexp"
+)
+
+var linkHeaderRegex = regexp.MustCompile(`<([^>]*)>\s*;\s*rel="?([^";]*)"?`)
 
 // ServiceResult is a holder object for the results of a service call
 type ServiceResult struct {
-	Header http.Header
-	Body   string
+	StatusCode int
+	Header     http.Header
+	Body       string
+}
+
+// Link returns the url of the Link header with the given rel (eg: "next", "differences"), or "" if there isn't one
+func (r *ServiceResult) Link(rel string) string {
+	for _, v := range r.Header[http.CanonicalHeaderKey("Link")] {
+		// a single header may hold several comma separated links
+		for _, match := range linkHeaderRegex.FindAllStringSubmatch(v, -1) {
+			if match[2] == rel {
+				return match[1]
+			}
+		}
+	}
+	return ""
 }
@@ -0,0 +1,98 @@
+package lti
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServiceRetryPolicy is how a ServiceConnector retries idempotent requests that fail with a Retryable ServiceError
+// (throttling, 5xx responses and unreachable platforms).  The delay before each retry is jittered, and doubles after
+// each attempt from BaseDelay up to MaxDelay, unless the platform sent a Retry-After header.
+type ServiceRetryPolicy struct {
+	// MaxAttempts is the most attempts made at a request, including the first; 1 or less disables retries
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// MaxRetryAfter is the longest Retry-After the connector will wait for, longer ones fail the request instead
+	MaxRetryAfter time.Duration
+	// OnRetry, if set, is called before each retry, eg: to count retries
+	OnRetry func(ServiceRetry)
+}
+
+// ServiceRetry describes a retry of a service request
+type ServiceRetry struct {
+	Method string
+	URL    string
+	// Attempt is the attempt that failed, starting at 1
+	Attempt int
+	// Delay is how long the connector waits before the next attempt
+	Delay time.Duration
+	Err   *ServiceError
+	// TokenRefresh is true when the platform rejected the access token, and the request is retried with a new one
+	TokenRefresh bool
+}
+
+// DefaultServiceRetryPolicy makes up to 3 attempts at a request
+var DefaultServiceRetryPolicy = ServiceRetryPolicy{MaxAttempts: 3, BaseDelay: 500 * time.Millisecond, MaxDelay: 10 * time.Second, MaxRetryAfter: 30 * time.Second}
+
+// delay returns how long to wait before retrying after the attempt failed with svcErr, and false if the platform
+// asked for a longer wait than the policy allows
+func (p ServiceRetryPolicy) delay(attempt int, svcErr *ServiceError) (time.Duration, bool) {
+	if retryAfter, ok := parseRetryAfter(svcErr.Header, time.Now()); ok {
+		if p.MaxRetryAfter > 0 && retryAfter > p.MaxRetryAfter {
+			return 0, false
+		}
+		return retryAfter, true
+	}
+	delay := p.BaseDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			delay = p.MaxDelay
+			break
+		}
+	}
+	// somewhere between half and all of the delay, so clients that failed together don't retry together
+	if half := int64(delay / 2); half > 0 {
+		delay = time.Duration(half + rand.Int63n(half+1))
+	}
+	return delay, true
+}
+
+func (p ServiceRetryPolicy) notify(retry ServiceRetry) {
+	if p.OnRetry != nil {
+		p.OnRetry(retry)
+	}
+}
+
+// parseRetryAfter reads a Retry-After header, in either delay-seconds or http-date form
+func parseRetryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			seconds = 0
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if delay := at.Sub(now); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package lti
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+)
+
+const (
+	// used when the platform's token response has no expires_in
+	defaultTokenLifetime = 5 * time.Minute
+	// tokens are refreshed this long before they expire (or at half their lifetime, for short lived tokens)
+	defaultTokenRefreshBefore = time.Minute
+)
+
+// DefaultAccessTokenCache is the token cache shared by ServiceConnectors, so service tokens are reused across launches
+var DefaultAccessTokenCache = NewAccessTokenCache(defaultTokenRefreshBefore)
+
+// AccessTokenCache holds service access tokens, keyed by registration and scope set.  It is safe for concurrent use,
+// and concurrent requests for the same missing token share a single fetch, which no single caller can cancel.
+type AccessTokenCache struct {
+	refreshBefore time.Duration
+	mu            sync.Mutex
+	tokens        map[string]cachedToken
+	inflight      map[string]*tokenFetch
+}
+
+type cachedToken struct {
+	token     string
+	refreshAt time.Time
+	expiresAt time.Time
+}
+
+type tokenFetch struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// TokenFetcher fetches a new access token, returning it with its lifetime (zero if the platform didn't give one)
+type TokenFetcher func(ctx context.Context) (token string, expiresIn time.Duration, err error)
+
+// NewAccessTokenCache creates a cache that refreshes tokens refreshBefore their expiry
+func NewAccessTokenCache(refreshBefore time.Duration) *AccessTokenCache {
+	return &AccessTokenCache{refreshBefore: refreshBefore, tokens: make(map[string]cachedToken), inflight: make(map[string]*tokenFetch)}
+}
+
+// Get returns the cached token for the key, calling fetch if there is none or it is due to be refreshed.  The fetch is
+// shared by every caller waiting for the key, so it runs without the callers' contexts; ctx only ends this caller's wait.
+// If a refresh fails the cached token is returned until it expires.
+func (c *AccessTokenCache) Get(ctx context.Context, key string, fetch TokenFetcher) (string, error) {
+	c.mu.Lock()
+	if cached, exists := c.tokens[key]; exists && time.Now().Before(cached.refreshAt) {
+		c.mu.Unlock()
+		return cached.token, nil
+	}
+	call, exists := c.inflight[key]
+	if !exists {
+		call = &tokenFetch{done: make(chan struct{})}
+		c.inflight[key] = call
+		go c.fetch(key, call, fetch)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.token, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (c *AccessTokenCache) fetch(key string, call *tokenFetch, fetch TokenFetcher) {
+	token, expiresIn, err := fetch(context.Background())
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if err == nil {
+		c.removeExpired(time.Now())
+		c.tokens[key] = c.newCachedToken(token, expiresIn)
+	} else if cached, exists := c.tokens[key]; exists && time.Now().Before(cached.expiresAt) {
+		// the refresh failed, but the token being refreshed can still be used until it expires
+		token, err = cached.token, nil
+	}
+	c.mu.Unlock()
+	call.token, call.err = token, err
+	close(call.done)
+}
+
+// Invalidate drops the cached token for the key if it is still the given token (eg: one the platform rejected), so the
+// next Get fetches a new one.  A token fetched since the rejected one was handed out is kept.
+func (c *AccessTokenCache) Invalidate(key, token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, exists := c.tokens[key]; exists && cached.token == token {
+		delete(c.tokens, key)
+	}
+	c.removeExpired(time.Now())
+}
+
+// removeExpired drops expired tokens, so registrations and scopes no longer used don't stay cached.  The caller must
+// hold the lock.
+func (c *AccessTokenCache) removeExpired(now time.Time) {
+	for key, cached := range c.tokens {
+		if !now.Before(cached.expiresAt) {
+			delete(c.tokens, key)
+		}
+	}
+}
+
+func (c *AccessTokenCache) newCachedToken(token string, expiresIn time.Duration) cachedToken {
+	if expiresIn <= 0 {
+		expiresIn = defaultTokenLifetime
+	}
+	early := c.refreshBefore
+	if early > expiresIn/2 {
+		early = expiresIn / 2
+	}
+	now := time.Now()
+	return cachedToken{token: token, refreshAt: now.Add(expiresIn - early), expiresAt: now.Add(expiresIn)}
+}
+
+// accessTokenKey identifies a registration's token for a set of scopes, whatever order the scopes are in
+func accessTokenKey(reg registrationDatastore.Registration, scopes []string) string {
+	sorted := append([]string(nil), scopes...)
+	sort.Strings(sorted)
+	return strings.Join([]string{reg.Issuer, reg.ClientID, reg.AuthTokenURL, strings.Join(sorted, " ")}, "|")
+}
@@ -0,0 +1,154 @@
+package lti_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GRT/lti-1-3-go-library/lti"
+)
+
+func TestAccessTokenCache(t *testing.T) {
+	cache := lti.NewAccessTokenCache(time.Minute)
+	var fetches int32
+	fetch := func(context.Context) (string, time.Duration, error) {
+		n := atomic.AddInt32(&fetches, 1)
+		time.Sleep(20 * time.Millisecond)
+		return fmt.Sprintf("token-%d", n), time.Hour, nil
+	}
+
+	// concurrent requests for the same key share one fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := cache.Get(context.Background(), "key", fetch); err != nil || token != "token-1" {
+				t.Errorf("unexpected token: %q, %v", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if fetches != 1 {
+		t.Fatalf("expected a single fetch, got %d", fetches)
+	}
+
+	cache.Invalidate("key", "token-1")
+	if token, _ := cache.Get(context.Background(), "key", fetch); token != "token-2" {
+		t.Fatalf("expected a new token after invalidating, got %q", token)
+	}
+	// a token rejected before the current one was fetched doesn't invalidate it
+	cache.Invalidate("key", "token-1")
+	if token, _ := cache.Get(context.Background(), "key", fetch); token != "token-2" {
+		t.Fatalf("expected the current token to be kept, got %q", token)
+	}
+
+	// short lived tokens are refreshed at half their lifetime
+	short := func(context.Context) (string, time.Duration, error) {
+		n := atomic.AddInt32(&fetches, 1)
+		return fmt.Sprintf("token-%d", n), 100 * time.Millisecond, nil
+	}
+	first, _ := cache.Get(context.Background(), "short", short)
+	if again, _ := cache.Get(context.Background(), "short", short); again != first {
+		t.Fatalf("the token should be reused before it is due for refresh")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if refreshed, _ := cache.Get(context.Background(), "short", short); refreshed == first {
+		t.Fatalf("the token should be refreshed before it expires")
+	}
+
+	// a failed refresh keeps serving the cached token until it expires
+	failing := func(context.Context) (string, time.Duration, error) {
+		return "", 0, errors.New("platform unavailable")
+	}
+	current, _ := cache.Get(context.Background(), "short", short)
+	time.Sleep(60 * time.Millisecond)
+	if token, err := cache.Get(context.Background(), "short", failing); err != nil || token != current {
+		t.Fatalf("expected the unexpired token when the refresh fails, got: %q, %v", token, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := cache.Get(context.Background(), "short", failing); err == nil {
+		t.Fatalf("expected the refresh error once the token has expired")
+	}
+}
+
+func TestAccessTokenCacheCancel(t *testing.T) {
+	cache := lti.NewAccessTokenCache(time.Minute)
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (string, time.Duration, error) {
+		select {
+		case <-release:
+			return "token", time.Hour, nil
+		case <-ctx.Done():
+			return "", 0, ctx.Err()
+		}
+	}
+
+	// the caller that started the fetch gives up, the fetch carries on for the others
+	first, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := cache.Get(first, "key", fetch)
+		firstErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	waiter := make(chan string)
+	go func() {
+		token, _ := cache.Get(context.Background(), "key", fetch)
+		waiter <- token
+	}()
+	cancel()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancelled caller to stop waiting, got: %v", err)
+	}
+
+	// a waiter can give up without waiting for the fetch
+	impatient, cancelImpatient := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelImpatient()
+	if _, err := cache.Get(impatient, "key", fetch); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the waiter's own deadline, got: %v", err)
+	}
+
+	close(release)
+	if token := <-waiter; token != "token" {
+		t.Fatalf("expected the remaining waiter to get the token, got %q", token)
+	}
+}
+
+func TestServiceConnectorSharesTokens(t *testing.T) {
+	var tokenFetches int32
+	platform := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			atomic.AddInt32(&tokenFetches, 1)
+			fmt.Fprint(w, `{"access_token": "shared-token", "token_type": "Bearer", "expires_in": 3600}`)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer shared-token" {
+			http.Error(w, "bad token", 401)
+			return
+		}
+		fmt.Fprint(w, `{"id": "m1", "context": {"id": "ctx1"}, "members": []}`)
+	}))
+	defer platform.Close()
+	reg := getTestRegistration(t)
+	reg.AuthTokenURL = platform.URL + "/token"
+	tokens := lti.NewAccessTokenCache(time.Minute)
+
+	// a connector per launch, as GetNrps creates, still reuses the token
+	for i := 0; i < 3; i++ {
+		conn := lti.NewServiceConnectorWithTokenCache(*reg, tokens)
+		svc := lti.NewNameRolesProvisioningService(conn, &lti.NrpsServiceClaim{ContextMembershipsURL: platform.URL + "/members"})
+		if _, err := svc.GetMembers(context.Background(), nil); err != nil {
+			t.Fatalf("GetMembers failed: %v", err)
+		}
+	}
+	if tokenFetches != 1 {
+		t.Fatalf("expected one token fetch shared by the connectors, got %d", tokenFetches)
+	}
+}
@@ -1,13 +1,24 @@
 package ltiCache
 
 import (
+	"errors"
 	"net/http"
 )
 
+var (
+	// ErrNonceNotFound is returned when a nonce was never issued to this browser, or was already used
+	ErrNonceNotFound = errors.New("nonce not found or already used")
+	// ErrNonceExpired is returned when a nonce was issued but its time to live has passed
+	ErrNonceExpired = errors.New("nonce expired")
+)
+
 type Cache interface {
 	// GetLaunchData returns the MapClaims bytes, key is the LaunchID
 	GetLaunchData(r *http.Request, launchID string) string
 	PutLaunchData(r *http.Request, launchID, jwtBody string)
+	// PutNonce records a newly issued nonce as outstanding.  Many nonces may be outstanding at once (eg: multiple tabs).
 	PutNonce(r *http.Request, nonce string)
-	CheckNonce(r *http.Request, nonce string) bool
+	// ConsumeNonce removes the nonce, so it can only be used once, and saves that before returning (the launch may
+	// still fail).  It returns ErrNonceNotFound or ErrNonceExpired if the nonce may not be used.
+	ConsumeNonce(w http.ResponseWriter, r *http.Request, nonce string) error
 }
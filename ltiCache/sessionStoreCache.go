@@ -1,9 +1,12 @@
 package ltiCache
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/sessions"
 )
@@ -12,15 +15,33 @@ type sessionStoreCache struct {
 	store sessions.Store
 	// name of the session cookie, generally
 	sessionName string
+	// how long an issued nonce may be used for
+	nonceTTL time.Duration
+	// consumed holds the used nonces (nonce -> expiry in unix nanos) until they expire, so a nonce is rejected by a
+	// replay of an earlier copy of the session (eg: its cookie), or a concurrent request that loaded the session first
+	mu       sync.Mutex
+	consumed map[string]int64
 }
 
 const (
 	sessionKeyPrefix = "sessionStoreCache."
-	nonceKey         = "nonce"
+	noncesKey        = "nonces"
+	// DefaultNonceTTL is how long a nonce stays valid when no ttl is given
+	DefaultNonceTTL = 10 * time.Minute
+	// the most nonces kept per browser session, the oldest are dropped first
+	maxOutstandingNonces = 20
 )
 
 func NewSessionStoreCache(store sessions.Store, sessionName string) Cache {
-	return &sessionStoreCache{store, sessionName}
+	return NewSessionStoreCacheWithNonceTTL(store, sessionName, DefaultNonceTTL)
+}
+
+// NewSessionStoreCacheWithNonceTTL creates a session store cache whose nonces expire after the given ttl
+func NewSessionStoreCacheWithNonceTTL(store sessions.Store, sessionName string, nonceTTL time.Duration) Cache {
+	if nonceTTL <= 0 {
+		nonceTTL = DefaultNonceTTL
+	}
+	return &sessionStoreCache{store: store, sessionName: sessionName, nonceTTL: nonceTTL, consumed: make(map[string]int64)}
 }
 
 func (c *sessionStoreCache) GetLaunchData(r *http.Request, key string) string {
@@ -32,16 +53,85 @@ func (c *sessionStoreCache) PutLaunchData(r *http.Request, key, jwtBody string)
 }
 
 func (c *sessionStoreCache) PutNonce(r *http.Request, nonce string) {
-	c.putValueWithKey(r, nonceKey, nonce)
+	now := time.Now()
+	nonces := c.fetchNonces(r)
+	pruneExpiredNonces(nonces, now)
+	for len(nonces) >= maxOutstandingNonces {
+		delete(nonces, oldestNonce(nonces))
+	}
+	nonces[nonce] = now.Add(c.nonceTTL).UnixNano()
+	c.putNonces(r, nonces)
+}
+
+func (c *sessionStoreCache) ConsumeNonce(w http.ResponseWriter, r *http.Request, nonce string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	pruneExpiredNonces(c.consumed, now)
+	if _, used := c.consumed[nonce]; used {
+		log.Printf("request nonce (%q) was already used, reject.", nonce)
+		return ErrNonceNotFound
+	}
+	nonces := c.fetchNonces(r)
+	expiry, found := nonces[nonce]
+	delete(nonces, nonce)
+	pruneExpiredNonces(nonces, now)
+	c.putNonces(r, nonces)
+	if !found {
+		log.Printf("request nonce (%q) is not outstanding for this session, reject.", nonce)
+		return ErrNonceNotFound
+	}
+	c.consumed[nonce] = expiry
+	// save now, the launch handler doesn't save the session if the launch fails
+	session, _ := c.store.Get(r, c.sessionName)
+	if err := session.Save(r, w); err != nil {
+		return fmt.Errorf("failed to save the session after using nonce %q: %v", nonce, err)
+	}
+	if now.UnixNano() > expiry {
+		log.Printf("request nonce (%q) has expired, reject.", nonce)
+		return ErrNonceExpired
+	}
+	return nil
+}
+
+// fetchNonces returns the outstanding nonces for the session (nonce -> expiry in unix nanos)
+func (c *sessionStoreCache) fetchNonces(r *http.Request) map[string]int64 {
+	nonces := make(map[string]int64)
+	if v := c.fetchValueWithKey(r, noncesKey); v != "" {
+		if err := json.Unmarshal([]byte(v), &nonces); err != nil {
+			log.Printf("failed to parse the outstanding nonces, ignoring them: %v", err)
+			return make(map[string]int64)
+		}
+	}
+	return nonces
+}
+
+func (c *sessionStoreCache) putNonces(r *http.Request, nonces map[string]int64) {
+	b, err := json.Marshal(nonces)
+	if err != nil {
+		log.Printf("failed to serialize the outstanding nonces: %v", err)
+		return
+	}
+	c.putValueWithKey(r, noncesKey, string(b))
+}
+
+func pruneExpiredNonces(nonces map[string]int64, now time.Time) {
+	for n, expiry := range nonces {
+		if now.UnixNano() > expiry {
+			delete(nonces, n)
+		}
+	}
 }
 
-func (c *sessionStoreCache) CheckNonce(r *http.Request, nonce string) bool {
-	cachedNonce := c.fetchValueWithKey(r, nonceKey)
-	if cachedNonce == "" || cachedNonce != nonce {
-		log.Printf("cached Nonce (%q) is not equal to request nonce (%q), reject.", cachedNonce, nonce)
-		return false
+func oldestNonce(nonces map[string]int64) string {
+	var oldest string
+	var oldestExpiry int64
+	for n, expiry := range nonces {
+		if oldest == "" || expiry < oldestExpiry {
+			oldest, oldestExpiry = n, expiry
+		}
 	}
-	return true
+	return oldest
 }
 
 func (c *sessionStoreCache) fetchValueWithKey(r *http.Request, k string) string {
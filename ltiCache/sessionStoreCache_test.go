@@ -2,9 +2,12 @@ package ltiCache_test
 
 import (
 	"fmt"
+	"net/http"
 	"net/http/httptest"
+	"sync"
 	"github.com/GRT/lti-1-3-go-library/ltiCache"
 	"testing"
+	"time"
 
 	"github.com/gorilla/sessions"
 
@@ -50,8 +53,96 @@ func TestPutFetchRequests(t *testing.T) {
 		t.Fatalf("expecting launchData of %q but got: %q", launchData, gotLaunchData)
 	}
 
-	goodNonce := cache.CheckNonce(req2, nonce)
-	if !goodNonce {
-		t.Fatalf("The Nonce did not check out!")
+	if err := cache.ConsumeNonce(httptest.NewRecorder(), req2, nonce); err != nil {
+		t.Fatalf("The Nonce did not check out: %v", err)
+	}
+}
+
+func TestNonceSingleUse(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	// two launches from two tabs, each with its own outstanding nonce
+	cache.PutNonce(req, "nonce-tab-1")
+	cache.PutNonce(req, "nonce-tab-2")
+
+	if err := cache.ConsumeNonce(httptest.NewRecorder(), req, "nonce-tab-1"); err != nil {
+		t.Fatalf("first tab nonce should be accepted: %v", err)
+	}
+	if err := cache.ConsumeNonce(httptest.NewRecorder(), req, "nonce-tab-2"); err != nil {
+		t.Fatalf("second tab nonce should be accepted: %v", err)
+	}
+	if err := cache.ConsumeNonce(httptest.NewRecorder(), req, "nonce-tab-1"); err != ltiCache.ErrNonceNotFound {
+		t.Fatalf("replayed nonce should be rejected with ErrNonceNotFound, got: %v", err)
+	}
+	if err := cache.ConsumeNonce(httptest.NewRecorder(), req, "nonce-never-issued"); err != ltiCache.ErrNonceNotFound {
+		t.Fatalf("unknown nonce should be rejected with ErrNonceNotFound, got: %v", err)
+	}
+}
+
+func TestNonceExpiry(t *testing.T) {
+	shortCache := ltiCache.NewSessionStoreCacheWithNonceTTL(store, sessionCookieName, time.Millisecond)
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	shortCache.PutNonce(req, nonce)
+	time.Sleep(5 * time.Millisecond)
+	if err := shortCache.ConsumeNonce(httptest.NewRecorder(), req, nonce); err != ltiCache.ErrNonceExpired {
+		t.Fatalf("expired nonce should be rejected with ErrNonceExpired, got: %v", err)
+	}
+}
+
+// requestWithSession returns a request carrying the session cookie set in rec
+func requestWithSession(rec *httptest.ResponseRecorder) *http.Request {
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func TestNonceReplay(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	issued := httptest.NewRecorder()
+	cache.PutNonce(req, "nonce-replayed")
+	session, _ := store.Get(req, sessionCookieName)
+	session.Save(req, issued)
+
+	// the launch fails after the nonce is used, so the handler doesn't save the session
+	consumed := httptest.NewRecorder()
+	if err := cache.ConsumeNonce(consumed, requestWithSession(issued), "nonce-replayed"); err != nil {
+		t.Fatalf("nonce should be accepted: %v", err)
+	}
+	if err := cache.ConsumeNonce(httptest.NewRecorder(), requestWithSession(issued), "nonce-replayed"); err != ltiCache.ErrNonceNotFound {
+		t.Fatalf("replaying the nonce with the earlier session should be rejected, got: %v", err)
+	}
+	// the session was saved without the nonce
+	fresh := ltiCache.NewSessionStoreCache(store, sessionCookieName)
+	if err := fresh.ConsumeNonce(httptest.NewRecorder(), requestWithSession(consumed), "nonce-replayed"); err != ltiCache.ErrNonceNotFound {
+		t.Fatalf("the saved session should not have the used nonce, got: %v", err)
+	}
+}
+
+func TestNonceConcurrentReplay(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	issued := httptest.NewRecorder()
+	cache.PutNonce(req, "nonce-concurrent")
+	session, _ := store.Get(req, sessionCookieName)
+	session.Save(req, issued)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		replay := requestWithSession(issued)
+		go func() {
+			defer wg.Done()
+			if err := cache.ConsumeNonce(httptest.NewRecorder(), replay, "nonce-concurrent"); err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted != 1 {
+		t.Fatalf("expected the nonce to be accepted once, accepted: %d", accepted)
 	}
 }
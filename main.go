@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"github.com/GRT/lti-1-3-go-library/gradeOutbox"
 	"github.com/GRT/lti-1-3-go-library/lti"
 	"github.com/GRT/lti-1-3-go-library/ltiCache"
 	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
 
-	jwt "github.com/dgrijalva/jwt-go"
+	jwt "github.com/golang-jwt/jwt/v4"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 )
@@ -24,6 +30,10 @@ const (
 	exampleMembersURL         = "/example/members"
 	exampleGradeURL           = "/example/grade"
 	exampleGradesURL          = "/example/grades"
+	exampleQueueGradeURL      = "/example/queuegrade"
+	exampleDeepLinkURL        = "/example/deeplink"
+	exampleJWKSURL            = "/example/jwks"
+	exampleRegisterURL        = "/example/register"
 	examplePayloadTemplateStr = `
 		<html><head>
 		<script>
@@ -45,14 +55,12 @@ const (
 				var payload = JSON.stringify(obj, undefined, 2);
 				console.log('payload:', payload);
 				document.getElementById('memberelement').innerHTML = payload;
-				// copy the members (screen out blanks)
+				// copy the members
 				for (i = 0; i < obj.members.length; ++i) {
-					if(obj.members[i].user_id && obj.members[i].user_id !== "") {
-						var idx = myMembers.length
-						myMembers.push(obj.members[i])
-						memberMap[obj.members[i].user_id] = obj.members[i];
-						gradeamember += "\n<tr><td>" + (idx+1) + ") " + myMembers[idx].name + "</td><td>" + myMembers[idx].roles.join(",") + "</td><td>Grade: <input type=\"text\" size=\"3\" id=\"grade" + idx + "\" /> <button onclick=\"doGrade(" + idx + ")\">Send Grade</button> </td></tr>";
-					}
+					var idx = myMembers.length
+					myMembers.push(obj.members[i])
+					memberMap[obj.members[i].user_id] = obj.members[i];
+					gradeamember += "\n<tr><td>" + (idx+1) + ") " + myMembers[idx].name + "</td><td>" + myMembers[idx].roles.join(",") + "</td><td>Grade: <input type=\"text\" size=\"3\" id=\"grade" + idx + "\" /> <button onclick=\"doGrade(" + idx + ")\">Send Grade</button> </td></tr>";
 				}
 				console.log("member map: " + JSON.stringify(memberMap));
 				gradeamember += "\n</table>";
@@ -94,7 +102,7 @@ const (
 			request.send();
 		}
 		function isValidGrade(str) {
-			return /^\+?(0|[1-9]\d*)$/.test(str);
+			return /^\+?(0|[1-9]\d*)(\.\d+)?$/.test(str);
 		}
 		
 
@@ -163,12 +171,20 @@ const (
 						<div id='gradelist'></div>
 
 					</td></tr>
+				<!-- DEEP LINKING -->
+				{{ if .IsDeepLink }}
+				<tr><td>Deep Linking</td>
+					<td><a href="{{.DeepLinkPathPart}}?launchId={{.LaunchID}}">Return the example resource link to the platform</a></td></tr>
+				{{ end }}
 			</table>
 			
 	  </body></html>
 	`
 )
 
+// exampleRegistrationHosts are the platforms allowed to register the example tool with dynamic registration
+var exampleRegistrationHosts = []string{"lti-ri.imsglobal.org"}
+
 var (
 	store                       sessions.Store
 	cache                       ltiCache.Cache
@@ -178,6 +194,11 @@ var (
 	nrpsGetMemberHandlerCreator func(http.Handler) http.Handler
 	agsPutGradeHandlerCreator   func(http.Handler) http.Handler
 	agsGetGradeHandlerCreator   func(http.Handler) http.Handler
+	agsQueueGradeHandlerCreator func(http.Handler) http.Handler
+	outbox                      *gradeOutbox.Outbox
+	deepLinkHandlerCreator      func(http.Handler) http.Handler
+	jwksHandler                 http.Handler
+	dynRegHandlerCreator        func(http.Handler) http.Handler
 	examplePayloadTemplate      *template.Template
 	loggingHandler              http.Handler
 )
@@ -195,7 +216,8 @@ func init() {
 	log.Printf("FsStore created, maxLen: %d, root dir: %s", fsStoreMaxLength, fsStoreRootPath)
 	cache = ltiCache.NewSessionStoreCache(store, sessionCookieName)
 	// TODO: this should be passed in via param
-	regDS, err := registrationDatastore.NewJsonRegistrationDatastore("./registrationDatastore/registrations.json")
+	// writable, so dynamic registration can add new platforms
+	regDS, err := registrationDatastore.NewWritableJsonRegistrationDatastore("./registrationDatastore/registrations.json")
 	if err != nil {
 		panic("no registration datastore was found!")
 	}
@@ -210,6 +232,39 @@ func init() {
 	exampleLineItem := &lti.LineItem{ScoreMax: 100, Label: "Example LI", Tag: "example_li"}
 	agsPutGradeHandlerCreator = lti.AgsPutGradeHandlerCreator(regDS, cache, store, sessionCookieName, debugFlag, exampleLineItem)
 	agsGetGradeHandlerCreator = lti.AgsGetGradesHandlerCreator(regDS, cache, store, sessionCookieName, debugFlag, exampleLineItem)
+	// queued grades are kept on disk, so they survive restarts until the platform accepts them
+	outboxStore, err := gradeOutbox.NewFileStore(filepath.Join(os.TempDir(), "lti1_3_grade_outbox.json"))
+	if err != nil {
+		panic("grade outbox store could not be created!")
+	}
+	outbox = gradeOutbox.NewOutbox(outboxStore, lti.OutboxSender(regDS), gradeOutbox.DefaultRetryPolicy)
+	agsQueueGradeHandlerCreator = lti.AgsQueueGradeHandlerCreator(regDS, cache, store, sessionCookieName, debugFlag, exampleLineItem, outbox)
+	deepLinkHandlerCreator = lti.DeepLinkResponseHandlerCreator(regDS, cache, store, sessionCookieName, debugFlag, exampleDeepLinkItems)
+	jwksHandler = lti.JWKSHandler(regDS)
+	dynRegHandlerCreator = lti.DynamicRegistrationHandlerCreator(regDS, lti.ToolConfiguration{
+		ClientName:       "GRT Go Test Tool",
+		InitiateLoginURI: fmt.Sprintf("%s%s", getBaseURL(), exampleLoginURL),
+		RedirectURIs:     []string{fmt.Sprintf("%s%s", getBaseURL(), exampleLaunchURL)},
+		JwksURI:          fmt.Sprintf("%s%s", getBaseURL(), exampleJWKSURL),
+		TargetLinkURI:    fmt.Sprintf("%s%s", getBaseURL(), exampleLaunchURL),
+		Domain:           "localhost",
+		Scopes: []string{
+			"https://purl.imsglobal.org/spec/lti-ags/scope/lineitem",
+			"https://purl.imsglobal.org/spec/lti-ags/scope/result.readonly",
+			"https://purl.imsglobal.org/spec/lti-ags/scope/score",
+			"https://purl.imsglobal.org/spec/lti-nrps/scope/contextmembership.readonly",
+		},
+		Messages: []lti.ToolConfigurationMessage{{Type: "LtiDeepLinkingRequest", TargetLinkURI: fmt.Sprintf("%s%s", getBaseURL(), exampleLaunchURL)}},
+		// only platforms the tool already trusts may register it
+		AllowPlatform: func(req *http.Request, configURL *url.URL) bool {
+			for _, host := range exampleRegistrationHosts {
+				if configURL.Scheme == "https" && strings.EqualFold(configURL.Host, host) {
+					return true
+				}
+			}
+			return false
+		},
+	})
 	loggingHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		log.Printf("done: /%s [launchID=%q]\n", req.URL.Path[1:], lti.GetLaunchID(req))
 	})
@@ -223,24 +278,39 @@ func otherHandler(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, "other: %s\n", req.URL.Path[1:])
 }
 
+// exampleDeepLinkItems answers every deep link request with a single resource link back to the example launch
+func exampleDeepLinkItems(req *http.Request, settings lti.DeepLinkingSettings) ([]lti.DeepLinkContentItem, error) {
+	item := lti.DeepLinkResourceLink{
+		Title: "GRT Go Test Tool",
+		Text:  "Example resource link created via deep linking",
+		URL:   fmt.Sprintf("%s%s", getBaseURL(), exampleLaunchURL),
+	}
+	return []lti.DeepLinkContentItem{item}, nil
+}
+
 func examplePayloadHandler(w http.ResponseWriter, req *http.Request) {
 	claims := lti.GetClaims(req)
 	launchID := lti.GetLaunchID(req)
 	log.Printf("examplePayloadHandler: launchID=%q", launchID)
+	launchClaims := lti.GetLaunchClaims(req)
 	data := struct {
-		Claims         jwt.MapClaims
-		MemberPathPart string
-		ScorePathPart  string
-		GradesPathPart string
-		LaunchID       string
-		DoggoSrc       template.URL
+		Claims           jwt.MapClaims
+		MemberPathPart   string
+		ScorePathPart    string
+		GradesPathPart   string
+		DeepLinkPathPart string
+		IsDeepLink       bool
+		LaunchID         string
+		DoggoSrc         template.URL
 	}{
-		Claims:         claims,
-		MemberPathPart: "members",
-		ScorePathPart:  "grade",
-		GradesPathPart: "grades",
-		LaunchID:       launchID,
-		DoggoSrc:       template.URL(doggoSrc),
+		Claims:           claims,
+		MemberPathPart:   "members",
+		ScorePathPart:    "grade",
+		GradesPathPart:   "grades",
+		DeepLinkPathPart: "deeplink",
+		IsDeepLink:       launchClaims != nil && launchClaims.IsDeepLinkLaunch(),
+		LaunchID:         launchID,
+		DoggoSrc:         template.URL(doggoSrc),
 	}
 
 	if err := examplePayloadTemplate.Execute(w, data); err != nil {
@@ -257,6 +327,11 @@ func main() {
 	http.Handle(exampleMembersURL, nrpsGetMemberHandlerCreator(loggingHandler))
 	http.Handle(exampleGradeURL, agsPutGradeHandlerCreator(loggingHandler))
 	http.Handle(exampleGradesURL, agsGetGradeHandlerCreator(loggingHandler))
+	http.Handle(exampleQueueGradeURL, agsQueueGradeHandlerCreator(loggingHandler))
+	go outbox.Run(context.Background(), time.Minute)
+	http.Handle(exampleDeepLinkURL, deepLinkHandlerCreator(loggingHandler))
+	http.Handle(exampleJWKSURL, jwksHandler)
+	http.Handle(exampleRegisterURL, dynRegHandlerCreator(loggingHandler))
 	// TODO: port should be a param
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", defaultPort), nil))
 }
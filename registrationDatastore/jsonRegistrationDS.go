@@ -3,14 +3,35 @@ package registrationDatastore
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 )
 
 type jsonRegistrationDatastore struct {
-	regMap map[string]Registration
+	mu       sync.RWMutex
+	jsonPath string
+	regMap   map[registrationKey]Registration
+}
+
+// registrationKey identifies a registration, a platform may register the tool several times
+type registrationKey struct {
+	issuer   string
+	clientID string
 }
 
 func NewJsonRegistrationDatastore(jsonPath string) (RegistrationDatastore, error) {
+	return newJsonRegistrationDatastore(jsonPath)
+}
+
+// NewWritableJsonRegistrationDatastore creates a json file backed datastore that writes saved registrations back to the file
+func NewWritableJsonRegistrationDatastore(jsonPath string) (WritableRegistrationDatastore, error) {
+	return newJsonRegistrationDatastore(jsonPath)
+}
+
+func newJsonRegistrationDatastore(jsonPath string) (*jsonRegistrationDatastore, error) {
 	var regs []Registration
 	file, err := os.Open(jsonPath)
 	if err != nil {
@@ -22,36 +43,147 @@ func NewJsonRegistrationDatastore(jsonPath string) (RegistrationDatastore, error
 		return nil, err
 	}
 	regMap := convertRegsToRegMap(regs)
-	return &jsonRegistrationDatastore{regMap: regMap}, nil
+	return &jsonRegistrationDatastore{jsonPath: jsonPath, regMap: regMap}, nil
 }
 
 func (ds *jsonRegistrationDatastore) FindRegistration(issuer string) (*Registration, error) {
-	if reg, exists := ds.findRegistration(issuer); exists {
+	regs := ds.findRegistrations(issuer)
+	switch len(regs) {
+	case 0:
+		return nil, fmt.Errorf("Issuer not found")
+	case 1:
+		return &regs[0], nil
+	}
+	return nil, fmt.Errorf("Issuer %q has %d registrations, a client id is needed to choose one", issuer, len(regs))
+}
+
+func (ds *jsonRegistrationDatastore) FindRegistrationByClientID(issuer, clientID string) (*Registration, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	if reg, exists := ds.regMap[registrationKey{issuer, clientID}]; exists {
 		return &reg, nil
 	}
-	return nil, fmt.Errorf("Issuer not found")
+	return nil, fmt.Errorf("Registration not found for issuer %q and client id %q", issuer, clientID)
 }
 
 func (ds *jsonRegistrationDatastore) FindDeployment(issuer, deploymentID string) (*Deployment, error) {
-	if reg, exists := ds.findRegistration(issuer); exists {
-		for _, id := range reg.DeploymentIds {
-			if id == deploymentID {
-				return &Deployment{id}, nil
-			}
+	for _, reg := range ds.findRegistrations(issuer) {
+		if dep := findDeployment(reg, deploymentID); dep != nil {
+			return dep, nil
 		}
 	}
 	return nil, nil
 }
 
-func (ds *jsonRegistrationDatastore) findRegistration(issuer string) (Registration, bool) {
-	v, ok := ds.regMap[issuer]
-	return v, ok
+func (ds *jsonRegistrationDatastore) FindDeploymentByClientID(issuer, clientID, deploymentID string) (*Deployment, error) {
+	reg, err := ds.FindRegistrationByClientID(issuer, clientID)
+	if err != nil {
+		return nil, nil
+	}
+	return findDeployment(*reg, deploymentID), nil
+}
+
+func findDeployment(reg Registration, deploymentID string) *Deployment {
+	for _, id := range reg.DeploymentIds {
+		if id == deploymentID {
+			return &Deployment{id}
+		}
+	}
+	return nil
+}
+
+func (ds *jsonRegistrationDatastore) FindAllRegistrations() ([]Registration, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return ds.sortedRegistrations(), nil
+}
+
+func (ds *jsonRegistrationDatastore) SaveRegistration(reg Registration) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.storeRegistration(reg)
+}
+
+func (ds *jsonRegistrationDatastore) AddRegistration(reg Registration) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, exists := ds.regMap[registrationKey{reg.Issuer, reg.ClientID}]; exists {
+		return ErrRegistrationExists
+	}
+	return ds.storeRegistration(reg)
+}
+
+// storeRegistration puts the registration in the map and writes the file, the caller must hold the write lock
+func (ds *jsonRegistrationDatastore) storeRegistration(reg Registration) error {
+	key := registrationKey{reg.Issuer, reg.ClientID}
+	previous, existed := ds.regMap[key]
+	ds.regMap[key] = reg
+	if err := ds.writeFile(); err != nil {
+		// keep memory consistent with the file
+		if existed {
+			ds.regMap[key] = previous
+		} else {
+			delete(ds.regMap, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// findRegistrations returns the registrations of the issuer
+func (ds *jsonRegistrationDatastore) findRegistrations(issuer string) []Registration {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	regs := make([]Registration, 0, 1)
+	for key, reg := range ds.regMap {
+		if key.issuer == issuer {
+			regs = append(regs, reg)
+		}
+	}
+	return regs
+}
+
+// sortedRegistrations returns the registrations in a stable order, the caller must hold the lock
+func (ds *jsonRegistrationDatastore) sortedRegistrations() []Registration {
+	regs := make([]Registration, 0, len(ds.regMap))
+	for _, reg := range ds.regMap {
+		regs = append(regs, reg)
+	}
+	sort.Slice(regs, func(i, j int) bool {
+		if regs[i].Issuer != regs[j].Issuer {
+			return regs[i].Issuer < regs[j].Issuer
+		}
+		return regs[i].ClientID < regs[j].ClientID
+	})
+	return regs
+}
+
+// writeFile replaces the json file with the current registrations, the caller must hold the write lock
+func (ds *jsonRegistrationDatastore) writeFile() error {
+	b, err := json.MarshalIndent(ds.sortedRegistrations(), "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temp file and rename, so a failed write can't leave a truncated datastore behind
+	tmp, err := ioutil.TempFile(filepath.Dir(ds.jsonPath), filepath.Base(ds.jsonPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), ds.jsonPath)
 }
 
-func convertRegsToRegMap(regs []Registration) map[string]Registration {
-	m := make(map[string]Registration)
+func convertRegsToRegMap(regs []Registration) map[registrationKey]Registration {
+	m := make(map[registrationKey]Registration)
 	for _, reg := range regs {
-		m[reg.Issuer] = reg
+		m[registrationKey{reg.Issuer, reg.ClientID}] = reg
 	}
 	return m
 }
@@ -2,6 +2,9 @@ package registrationDatastore_test
 
 import (
 	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -65,3 +68,82 @@ func TestFindDepNo2(t *testing.T) {
 		t.Fatalf("Found a Deployment when none should be found (missing issuer)")
 	}
 }
+
+func TestFindRegByClientID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "regds")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registrations.json")
+	if err := ioutil.WriteFile(path, []byte("[]"), 0600); err != nil {
+		t.Fatalf("failed to write registrations file: %v", err)
+	}
+	ds, err := registrationDatastore.NewWritableJsonRegistrationDatastore(path)
+	if err != nil {
+		t.Fatalf("failed to create the writable json reg datastore: %v", err)
+	}
+
+	ds.SaveRegistration(registrationDatastore.Registration{Issuer: issuer, ClientID: "tool-a", DeploymentIds: []string{"dep-a"}})
+	if reg, err := ds.FindRegistration(issuer); err != nil || reg.ClientID != "tool-a" {
+		t.Fatalf("expected the issuer's only registration, got: %v", err)
+	}
+	ds.SaveRegistration(registrationDatastore.Registration{Issuer: issuer, ClientID: "tool-b", DeploymentIds: []string{"dep-b"}})
+	if _, err := ds.FindRegistration(issuer); err == nil {
+		t.Fatalf("expected issuer only lookup to fail with several registrations")
+	}
+	for _, clientID := range []string{"tool-a", "tool-b"} {
+		if reg, err := ds.FindRegistrationByClientID(issuer, clientID); err != nil || reg.ClientID != clientID {
+			t.Fatalf("expected the registration for client id %q, got: %v", clientID, err)
+		}
+	}
+	if reg, _ := ds.FindRegistrationByClientID(issuer, "tool-c"); reg != nil {
+		t.Fatalf("Found a registration for an unknown client id")
+	}
+	if dep, _ := ds.FindDeploymentByClientID(issuer, "tool-b", "dep-b"); dep == nil {
+		t.Fatalf("Could not find deployment dep-b for client id tool-b")
+	}
+	if dep, _ := ds.FindDeploymentByClientID(issuer, "tool-a", "dep-b"); dep != nil {
+		t.Fatalf("Found deployment dep-b for client id tool-a")
+	}
+	if dep, _ := ds.FindDeployment(issuer, "dep-b"); dep == nil {
+		t.Fatalf("Could not find deployment dep-b in the issuer's registrations")
+	}
+
+	// both registrations are saved to the file
+	reloaded, err := registrationDatastore.NewJsonRegistrationDatastore(path)
+	if err != nil {
+		t.Fatalf("failed to reload the json reg datastore: %v", err)
+	}
+	if regs, _ := reloaded.FindAllRegistrations(); len(regs) != 2 {
+		t.Fatalf("expected 2 registrations, got: %d", len(regs))
+	}
+}
+
+func TestAddRegistration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "regds")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registrations.json")
+	if err := ioutil.WriteFile(path, []byte("[]"), 0600); err != nil {
+		t.Fatalf("failed to write registrations file: %v", err)
+	}
+	ds, err := registrationDatastore.NewWritableJsonRegistrationDatastore(path)
+	if err != nil {
+		t.Fatalf("failed to create the writable json reg datastore: %v", err)
+	}
+
+	if err := ds.AddRegistration(registrationDatastore.Registration{Issuer: issuer, ClientID: "tool-a", AuthLoginURL: "first"}); err != nil {
+		t.Fatalf("expected the registration to be added, got: %v", err)
+	}
+	// an existing registration is never replaced
+	err = ds.AddRegistration(registrationDatastore.Registration{Issuer: issuer, ClientID: "tool-a", AuthLoginURL: "second"})
+	if err != registrationDatastore.ErrRegistrationExists {
+		t.Fatalf("expected ErrRegistrationExists, got: %v", err)
+	}
+	if reg, _ := ds.FindRegistrationByClientID(issuer, "tool-a"); reg == nil || reg.AuthLoginURL != "first" {
+		t.Fatalf("expected the first registration to be kept, got: %+v", reg)
+	}
+}
@@ -0,0 +1,41 @@
+package registrationDatastore
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// HasPlatformKeys returns true if the registration has a source for the platform's public keys
+func (r Registration) HasPlatformKeys() bool {
+	return r.KeySetURL != "" || len(r.PlatformJWKS) > 0 || r.PlatformPublicKey != ""
+}
+
+// ParsePlatformPublicKey parses the registration's PlatformPublicKey PEM, which may be a PKIX public key ("PUBLIC KEY"),
+// a PKCS1 RSA public key ("RSA PUBLIC KEY") or a certificate
+func (r Registration) ParsePlatformPublicKey() (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(r.PlatformPublicKey))
+	if block == nil {
+		return nil, fmt.Errorf("platform public key for issuer %q is not PEM encoded", r.Issuer)
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		pubkey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("platform public key for issuer %q could not be parsed: %v", r.Issuer, err)
+		}
+		return pubkey, nil
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("platform certificate for issuer %q could not be parsed: %v", r.Issuer, err)
+		}
+		return cert.PublicKey, nil
+	}
+	pubkey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("platform public key for issuer %q could not be parsed: %v", r.Issuer, err)
+	}
+	return pubkey, nil
+}
@@ -0,0 +1,41 @@
+package registrationDatastore_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+)
+
+func TestParsePlatformPublicKey(t *testing.T) {
+	privkey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	pkix, _ := x509.MarshalPKIXPublicKey(&privkey.PublicKey)
+	for _, block := range []*pem.Block{
+		{Type: "PUBLIC KEY", Bytes: pkix},
+		{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&privkey.PublicKey)},
+	} {
+		reg := registrationDatastore.Registration{Issuer: "https://platform.example.com", PlatformPublicKey: string(pem.EncodeToMemory(block))}
+		if !reg.HasPlatformKeys() {
+			t.Fatalf("a registration with a platform public key has platform keys")
+		}
+		pubkey, err := reg.ParsePlatformPublicKey()
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", block.Type, err)
+		}
+		if rsaKey, ok := pubkey.(*rsa.PublicKey); !ok || rsaKey.N.Cmp(privkey.PublicKey.N) != 0 {
+			t.Fatalf("unexpected key parsed from %s: %v", block.Type, pubkey)
+		}
+	}
+	if _, err := (registrationDatastore.Registration{PlatformPublicKey: "not a key"}).ParsePlatformPublicKey(); err == nil {
+		t.Fatalf("expected an error for a key that isn't PEM")
+	}
+	if (registrationDatastore.Registration{Issuer: "https://platform.example.com"}).HasPlatformKeys() {
+		t.Fatalf("a registration with no key sources has no platform keys")
+	}
+}
@@ -1,20 +1,65 @@
 package registrationDatastore
 
+import (
+	"encoding/json"
+	"errors"
+)
+
+// ErrRegistrationExists is returned when adding a registration for an issuer and client id that is already registered
+var ErrRegistrationExists = errors.New("a registration already exists for the issuer and client id")
+
 type Deployment struct {
 	DeploymentID string `json:"deploymentId"`
 }
 
 type Registration struct {
-	Issuer         string   `json:"issuer"`
-	ClientID       string   `json:"clientId"`
-	KeySetURL      string   `json:"keySetUrl"`
-	AuthTokenURL   string   `json:"authTokenUrl"`
-	AuthLoginURL   string   `json:"authLoginUrl"`
-	ToolPrivateKey string   `json:"toolPrivateKey"`
-	DeploymentIds  []string `json:"deploymentIds,omitempty"`
+	Issuer         string `json:"issuer"`
+	ClientID       string `json:"clientId"`
+	KeySetURL      string `json:"keySetUrl,omitempty"`
+	AuthTokenURL   string `json:"authTokenUrl"`
+	AuthLoginURL   string `json:"authLoginUrl"`
+	ToolPrivateKey string `json:"toolPrivateKey,omitempty"`
+	// PlatformPublicKey (PEM) and PlatformJWKS (an inline JWK Set) are alternatives to KeySetURL, for platforms that
+	// don't publish their keys, or to validate launches without fetching them
+	PlatformPublicKey string          `json:"platformPublicKey,omitempty"`
+	PlatformJWKS      json.RawMessage `json:"platformJwks,omitempty"`
+	// AllowedAlgorithms are the id_token signing algorithms accepted from the platform (RS256, RS384, RS512, ES256 or
+	// PS256), RS256 when empty
+	AllowedAlgorithms []string `json:"allowedAlgorithms,omitempty"`
+	// IDTokenLeeway and IDTokenMaxAge (in seconds) override the launch handler's id_token clock skew leeway and maximum
+	// token age for this platform, nil for the handler's.  An IDTokenMaxAge of 0 means no limit.
+	IDTokenLeeway *int `json:"idTokenLeeway,omitempty"`
+	IDTokenMaxAge *int `json:"idTokenMaxAge,omitempty"`
+	// AuthTokenAudience is the aud of the service token client assertion, for platforms that want something other than AuthTokenURL
+	AuthTokenAudience string `json:"authTokenAudience,omitempty"`
+	// ClientAssertionLifetime is how long (in seconds) service token client assertions are valid for, 0 for the default
+	ClientAssertionLifetime int `json:"clientAssertionLifetime,omitempty"`
+	// ToolKeys allows several signing keys, for key rotation.  When empty, ToolPrivateKey is the single active key.
+	ToolKeys      []ToolKey `json:"toolKeys,omitempty"`
+	DeploymentIds []string  `json:"deploymentIds,omitempty"`
 }
 
+// RegistrationDatastore finds registrations, which are identified by issuer and client id: a platform may have
+// several registrations of the tool, each with its own client id
 type RegistrationDatastore interface {
+	// FindRegistration finds the registration of an issuer that has a single registration
 	FindRegistration(issuer string) (*Registration, error)
+	// FindRegistrationByClientID finds the issuer's registration with the client id
+	FindRegistrationByClientID(issuer, clientID string) (*Registration, error)
+	// FindDeployment finds the deployment in the registrations of the issuer
 	FindDeployment(issuer, deploymentID string) (*Deployment, error)
+	// FindDeploymentByClientID finds the deployment in the issuer's registration with the client id
+	FindDeploymentByClientID(issuer, clientID, deploymentID string) (*Deployment, error)
+	// FindAllRegistrations returns every registration (used to publish the tool's public keys)
+	FindAllRegistrations() ([]Registration, error)
+}
+
+// WritableRegistrationDatastore is a RegistrationDatastore that can also store registrations (eg: from dynamic registration)
+type WritableRegistrationDatastore interface {
+	RegistrationDatastore
+	// SaveRegistration adds the registration, replacing any existing registration for the same issuer and client id
+	SaveRegistration(reg Registration) error
+	// AddRegistration adds the registration, failing with ErrRegistrationExists if there is already one for the same
+	// issuer and client id
+	AddRegistration(reg Registration) error
 }
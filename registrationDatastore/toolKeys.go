@@ -0,0 +1,197 @@
+package registrationDatastore
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// ToolKeyStatus is where a tool key is in its rotation
+type ToolKeyStatus string
+
+const (
+	// ToolKeyActive keys are used to sign
+	ToolKeyActive ToolKeyStatus = "active"
+	// ToolKeyNext keys are published ahead of time, so platforms know them before they are used to sign
+	ToolKeyNext ToolKeyStatus = "next"
+	// ToolKeyRetired keys no longer sign, but stay published until their NotAfter so in flight tokens still verify
+	ToolKeyRetired ToolKeyStatus = "retired"
+)
+
+// ToolKey is one of a registration's tool signing keys
+type ToolKey struct {
+	// KeyID is the kid; when empty the key's RFC 7638 thumbprint is used
+	KeyID      string        `json:"kid,omitempty"`
+	Status     ToolKeyStatus `json:"status"`
+	NotBefore  *time.Time    `json:"notBefore,omitempty"`
+	NotAfter   *time.Time    `json:"notAfter,omitempty"`
+	PrivateKey string        `json:"privateKey"`
+}
+
+// InWindow returns true if t is within the key's not-before/not-after window
+func (k ToolKey) InWindow(t time.Time) bool {
+	if k.NotBefore != nil && t.Before(*k.NotBefore) {
+		return false
+	}
+	if k.NotAfter != nil && t.After(*k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// RSAPrivateKey parses the key's PEM (PKCS1 or PKCS8)
+func (k ToolKey) RSAPrivateKey() (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(k.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("tool key %q is not PEM encoded", k.KeyID)
+	}
+	if privkey, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return privkey, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("tool key %q could not be parsed: %v", k.KeyID, err)
+	}
+	privkey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("tool key %q is not an RSA key", k.KeyID)
+	}
+	return privkey, nil
+}
+
+// ID returns the key's kid, deriving it from the public key when it isn't set
+func (k ToolKey) ID() (string, error) {
+	if k.KeyID != "" {
+		return k.KeyID, nil
+	}
+	privkey, err := k.RSAPrivateKey()
+	if err != nil {
+		return "", err
+	}
+	return KeyThumbprint(&privkey.PublicKey)
+}
+
+// KeyThumbprint returns the RFC 7638 thumbprint (SHA-256, base64url encoded) of an RSA public key
+func KeyThumbprint(pubkey *rsa.PublicKey) (string, error) {
+	// the members must be in lexical order, with no whitespace
+	b, err := json.Marshal(struct {
+		E   string `json:"e"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+	}{
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pubkey.E)).Bytes()),
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(pubkey.N.Bytes()),
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// GetToolKeys returns the registration's tool keys.  A registration with only a ToolPrivateKey has that key as its single active key.
+func (r Registration) GetToolKeys() []ToolKey {
+	if len(r.ToolKeys) == 0 && r.ToolPrivateKey != "" {
+		return []ToolKey{{Status: ToolKeyActive, PrivateKey: r.ToolPrivateKey}}
+	}
+	return r.ToolKeys
+}
+
+// SigningKey returns the active key to sign with at the given time.  If several active keys are in their window,
+// the one that became valid most recently wins.
+func (r Registration) SigningKey(now time.Time) (*ToolKey, error) {
+	var signing *ToolKey
+	for _, k := range r.GetToolKeys() {
+		if k.Status != ToolKeyActive || !k.InWindow(now) {
+			continue
+		}
+		if signing == nil || notBeforeOf(k).After(notBeforeOf(*signing)) {
+			key := k
+			signing = &key
+		}
+	}
+	if signing == nil {
+		return nil, fmt.Errorf("no active tool key for clientId: %q", r.ClientID)
+	}
+	return signing, nil
+}
+
+// PublishedKeys returns the keys whose public part should be in the tool's JWKS: active and next keys,
+// plus retired keys until their NotAfter passes
+func (r Registration) PublishedKeys(now time.Time) []ToolKey {
+	keys := make([]ToolKey, 0)
+	for _, k := range r.GetToolKeys() {
+		if k.NotAfter != nil && now.After(*k.NotAfter) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// RotateToolKeys advances the registration's key rotation: the active keys are retired (published for retiredFor more),
+// the next key becomes active, and newNext (if given) becomes the next key.  Retired keys past their NotAfter are dropped.
+// A registration that only has a ToolPrivateKey is converted to use ToolKeys.
+func RotateToolKeys(reg *Registration, newNext *ToolKey, now time.Time, retiredFor time.Duration) error {
+	keys := reg.GetToolKeys()
+	nextIdx := -1
+	for i, k := range keys {
+		if k.Status == ToolKeyNext && (nextIdx < 0 || notBeforeOf(k).Before(notBeforeOf(keys[nextIdx]))) {
+			nextIdx = i
+		}
+	}
+	if nextIdx < 0 {
+		return fmt.Errorf("no next tool key to promote for clientId: %q", reg.ClientID)
+	}
+
+	retireAt := now.Add(retiredFor)
+	rotated := make([]ToolKey, 0, len(keys)+1)
+	for i, k := range keys {
+		switch {
+		case i == nextIdx:
+			k.Status = ToolKeyActive
+			k.NotBefore = &now
+		case k.Status == ToolKeyActive:
+			// the kid must not change when the key stops being derived from ToolPrivateKey
+			if k.KeyID == "" {
+				id, err := k.ID()
+				if err != nil {
+					return err
+				}
+				k.KeyID = id
+			}
+			k.Status = ToolKeyRetired
+			k.NotAfter = &retireAt
+		case k.Status == ToolKeyRetired && k.NotAfter != nil && now.After(*k.NotAfter):
+			continue
+		}
+		rotated = append(rotated, k)
+	}
+	if newNext != nil {
+		next := *newNext
+		next.Status = ToolKeyNext
+		rotated = append(rotated, next)
+	}
+	// active first, then next, then retired
+	statusOrder := map[ToolKeyStatus]int{ToolKeyActive: 0, ToolKeyNext: 1, ToolKeyRetired: 2}
+	sort.SliceStable(rotated, func(i, j int) bool { return statusOrder[rotated[i].Status] < statusOrder[rotated[j].Status] })
+
+	reg.ToolKeys = rotated
+	reg.ToolPrivateKey = ""
+	return nil
+}
+
+func notBeforeOf(k ToolKey) time.Time {
+	if k.NotBefore == nil {
+		return time.Time{}
+	}
+	return *k.NotBefore
+}
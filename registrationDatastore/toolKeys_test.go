@@ -0,0 +1,67 @@
+package registrationDatastore_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/GRT/lti-1-3-go-library/registrationDatastore"
+)
+
+func newPEMKey(t *testing.T) string {
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privkey)}))
+}
+
+func TestToolKeyRotation(t *testing.T) {
+	now := time.Now()
+	reg := registrationDatastore.Registration{ClientID: "rotating-client", ToolPrivateKey: newPEMKey(t)}
+	legacyKey, err := reg.SigningKey(now)
+	if err != nil {
+		t.Fatalf("a ToolPrivateKey registration should have an active key: %v", err)
+	}
+	legacyKid, _ := legacyKey.ID()
+
+	// rotating needs a next key to promote
+	if err := registrationDatastore.RotateToolKeys(&reg, nil, now, time.Hour); err == nil {
+		t.Fatalf("rotation without a next key should fail")
+	}
+	reg.ToolKeys = append(reg.GetToolKeys(), registrationDatastore.ToolKey{KeyID: "key-2", Status: registrationDatastore.ToolKeyNext, PrivateKey: newPEMKey(t)})
+	if len(reg.PublishedKeys(now)) != 2 {
+		t.Fatalf("active and next keys should both be published")
+	}
+	if k, _ := reg.SigningKey(now); k.KeyID == "key-2" {
+		t.Fatalf("the next key must not sign before it is promoted")
+	}
+
+	key3 := registrationDatastore.ToolKey{KeyID: "key-3", PrivateKey: newPEMKey(t)}
+	if err := registrationDatastore.RotateToolKeys(&reg, &key3, now, time.Hour); err != nil {
+		t.Fatalf("rotation failed: %v", err)
+	}
+	if k, _ := reg.SigningKey(now); k.KeyID != "key-2" {
+		t.Fatalf("expected key-2 to sign after rotation, got: %q", k.KeyID)
+	}
+	published := reg.PublishedKeys(now)
+	if len(published) != 3 {
+		t.Fatalf("expected active, next and retired keys to be published, got %d", len(published))
+	}
+	var retired *registrationDatastore.ToolKey
+	for i, k := range published {
+		if k.Status == registrationDatastore.ToolKeyRetired {
+			retired = &published[i]
+		}
+	}
+	if retired == nil || retired.KeyID != legacyKid {
+		t.Fatalf("the old key should be retired and keep its kid (%q), got: %+v", legacyKid, retired)
+	}
+	// once the retired key's window is over it is no longer published
+	if len(reg.PublishedKeys(now.Add(2*time.Hour))) != 2 {
+		t.Fatalf("retired key should not be published after its not-after time")
+	}
+}